@@ -1,35 +1,291 @@
 package scsu
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strings"
+	"sync"
 	"unicode/utf16"
+	"unicode/utf8"
 )
 
+// DecoderOptions control the behaviour of the Reader.
+type DecoderOptions struct {
+	// Lenient makes the Reader replace malformed sequences with utf8.RuneError (U+FFFD)
+	// and carry on rather than failing with ErrIllegalInput. The bytes that form
+	// the malformed sequence are skipped and decoding continues from the next byte.
+	// In particular, the reserved tag Srs (0x0C) produces one replacement character and only the tag
+	// itself is skipped, the byte following it is decoded as usual. Likewise, a high surrogate that is not
+	// followed by a low one is replaced on its own and the unit after it is decoded again.
+	// Truncated input is still reported as io.ErrUnexpectedEOF.
+	Lenient bool
+
+	// Replacement is the character that is used in lenient mode instead of utf8.RuneError.
+	// It must be a valid Unicode scalar value. Zero means utf8.RuneError.
+	Replacement rune
+
+	// StripBOM makes the Reader drop U+FEFF if it's the first decoded character regardless of how it
+	// is encoded (the SCSU signature, i.e. U+FEFF quoted with SQU, is always dropped).
+	StripBOM bool
+
+	// MaxRunes, if positive, limits the number of characters that can be decoded (including
+	// the replacement characters in lenient mode). Once the limit
+	// is exceeded ErrOutputTooLarge is returned.
+	MaxRunes int
+
+	// InitialWindows, if not nil, overrides the initial offsets of the dynamic windows. This must match
+	// the encoder's EncoderOptions.InitialWindows. Each offset must be between 0 and 0x10FF80.
+	InitialWindows *[8]int32
+
+	// InitialActiveWindow is the index (0-7) of the dynamic window that is active at the start. This must match
+	// the encoder's EncoderOptions.InitialActiveWindow.
+	InitialActiveWindow int
+
+	// InitialUnicodeMode makes the Reader start in Unicode mode, as if the input was preceded by SCU.
+	// This must match the encoder's EncoderOptions.InitialUnicodeMode.
+	InitialUnicodeMode bool
+
+	// RejectRedundant makes the Reader fail with ErrRedundantCommand if the input defines a dynamic window
+	// with the offset it already has, or selects the window that is already active. Such commands
+	// are legal, but a conformant encoder has no reason to produce them.
+	RejectRedundant bool
+
+	// MaxCommands, if positive, limits the number of consecutive commands (window selections
+	// and definitions, mode switches) that don't produce a character. Once the limit
+	// is exceeded ErrTooManyCommands is returned (also in lenient mode). This protects against degenerate
+	// input that consists of a long sequence of commands.
+	MaxCommands int
+
+	// MaxInputBytes, if positive, limits the number of bytes that can be read from the underlying reader.
+	// Once the limit is exceeded ErrInputTooLarge is returned. This protects against a reader that never ends.
+	MaxInputBytes int64
+
+	// TreatReservedAsLatin1 is a best-effort recovery mode for input produced by nonconformant encoders that
+	// emit raw bytes instead of quoting them. If set, the reserved tag Srs (0x0C) in the single byte mode
+	// is decoded as the Latin-1 character with the same code (U+000C, form feed) rather than
+	// being treated as malformed input. It takes precedence over Lenient.
+	TreatReservedAsLatin1 bool
+}
+
+// Reader decodes SCSU read from the underlying io.ByteReader. It holds the decoder state
+// (the windows and the mode), so it is not safe for concurrent use. Each goroutine should use
+// its own Reader; if allocations matter, Readers can be re-used (see Reset), for example with a sync.Pool.
+// If a single stream has to be shared between goroutines, the calls must be serialised by the caller
+// (e.g. with a sync.Mutex).
 type Reader struct {
 	scsu
 	brd       io.ByteReader
-	bytesRead int
+	src       *sliceByteReader // same as brd if it's a *sliceByteReader, so that it can be read without an interface call
+	bytesRead int64
+	maxBytes  int64 // opts.MaxInputBytes or math.MaxInt64 if there is no limit
+	runesRead int
+	commands  int // the number of consecutive commands without a character
+	opts      DecoderOptions
+
+	pending    [utf8.UTFMax]byte // UTF-8 bytes of a rune that did not fit into the buffer passed to Read
+	pendingPos int
+	pendingLen int
+	readErr    error
+
+	chunkTail []byte // the incomplete sequence at the end of the previous chunk passed to DecodeChunk
+
+	onCommand func(CommandInfo)
+
+	ctx context.Context // the context of ReadStringContext while it's running, checked in command()
+
+	stopAfterCommand bool // makes expandSingleByte return -1 after each command, so that RecordDecoder sees every byte boundary
+
+	unreadBuf [maxUnread]byte // bytes put back by unreadBytes if brd is not a *sliceByteReader
+	unreadPos int
+	unreadLen int
+
+	last      readerState // the state before the last ReadRune
+	after     readerState // the state after the last ReadRune, if it has been unread
+	lastRune  rune
+	canUnread bool // whether the last operation was a successful ReadRune
+	unread    bool // whether UnreadRune has been called, i.e. lastRune has to be returned by the next read
+}
+
+// readerState is the part of the Reader state that is restored by UnreadRune
+type readerState struct {
+	scsu
+	bytesRead int64
+	runesRead int
+	commands  int
+}
+
+// CommandInfo describes a command decoded by the Reader, see OnCommand.
+type CommandInfo struct {
+	Offset int64 // the offset of the tag byte in the input
+	Tag    byte  // the tag byte, e.g. SQ0 or UDX
+
+	// Window is the index of the window the command selects, defines or quotes from, -1 for SCU, SQU and UQU.
+	Window int
+
+	// WindowOffset is the offset of the window (after the command has been applied), for SQn quoting
+	// a byte value below 0x80 it's the offset of the static window.
+	WindowOffset int32
+
+	// Char is the quoted character for SQn, SQU and UQU, -1 for the other commands.
+	Char rune
 }
 
 var (
-	ErrIllegalInput = errors.New("illegal input")
+	ErrIllegalInput   = errors.New("illegal input")
+	ErrOutputTooLarge = errors.New("output too large")
+	ErrInputTooLarge  = errors.New("input too large")
+
+	ErrRedundantCommand = errors.New("redundant command")
+	ErrTooManyCommands  = errors.New("too many consecutive commands")
+
+	// ErrInvalidUnreadRune is returned by UnreadRune if the previous operation was not a successful ReadRune.
+	ErrInvalidUnreadRune = errors.New("invalid use of UnreadRune")
+
+	// ErrNeedMore is returned by DecodeChunk if the chunk ends with an incomplete command or character.
+	ErrNeedMore = errors.New("need more input")
 )
 
+// DecodeError describes a malformed input. It wraps the underlying error (such as ErrIllegalInput),
+// so errors.Is() can be used to check for it.
+type DecodeError struct {
+	Offset int64 // the number of input bytes consumed when the error was detected
+	Rune   int   // the number of characters decoded before the error, i.e. the index of the failed character
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
 func NewReader(r io.ByteReader) *Reader {
-	d := &Reader{
-		brd: r,
+	d := new(Reader)
+	d.setByteReader(r)
+	d.init()
+	return d
+}
+
+// NewReaderFrom is like NewReader but accepts an io.Reader. If r does not implement io.ByteReader
+// the input is read from r in chunks into an internal buffer, therefore more bytes than needed may be read from r.
+func NewReaderFrom(r io.Reader) *Reader {
+	if br, ok := r.(io.ByteReader); ok {
+		return NewReader(br)
 	}
+	return NewReader(&sliceByteReader{b: make([]byte, 0, readAheadSize), rd: r})
+}
+
+// NewReaderString is like NewReader but reads from a string without copying it.
+func NewReaderString(s string) *Reader {
+	return NewReader(strings.NewReader(s))
+}
+
+// NewReaderWithOptions is like NewReader but allows to specify the decoding options.
+// It panics if opts.Replacement is not a valid Unicode scalar value or if any of opts.InitialWindows
+// or opts.InitialActiveWindow is out of range.
+func NewReaderWithOptions(r io.ByteReader, opts DecoderOptions) *Reader {
+	if opts.Replacement == 0 {
+		opts.Replacement = utf8.RuneError
+	} else if !utf8.ValidRune(opts.Replacement) {
+		panic(fmt.Errorf("scsu: invalid replacement character %#x", opts.Replacement))
+	}
+	checkInitialWindows(opts.InitialWindows, opts.InitialActiveWindow)
+	d := NewReader(r)
+	d.opts = opts
 	d.init()
 	return d
 }
 
+func (r *Reader) init() {
+	r.scsu.init()
+	if r.opts.InitialWindows != nil {
+		r.dynamicOffset = *r.opts.InitialWindows
+	}
+	r.window = r.opts.InitialActiveWindow
+	r.unicodeMode = r.opts.InitialUnicodeMode
+	r.maxBytes = math.MaxInt64
+	if r.opts.MaxInputBytes > 0 {
+		r.maxBytes = r.opts.MaxInputBytes
+	}
+}
+
+func (r *Reader) setByteReader(rd io.ByteReader) {
+	r.brd = rd
+	r.src, _ = rd.(*sliceByteReader)
+}
+
+// command is called for every command that does not produce a character
+func (r *Reader) command() error {
+	if r.commands++; r.opts.MaxCommands > 0 && r.commands > r.opts.MaxCommands {
+		return fmt.Errorf("%w: more than %d", ErrTooManyCommands, r.opts.MaxCommands)
+	}
+	if r.ctx != nil && r.commands%ctxCheckInterval == 0 {
+		// a long run of commands does not produce any runes, so it's not covered by the check in readStringInto
+		return r.ctx.Err()
+	}
+	return nil
+}
+
 func (r *Reader) readByte() (byte, error) {
-	b, err := r.brd.ReadByte()
+	if s := r.src; s != nil {
+		if s.pos < len(s.b) && r.bytesRead < r.maxBytes {
+			b := s.b[s.pos]
+			s.pos++
+			r.bytesRead++
+			return b, nil
+		}
+		return r.countByte(s.ReadByte())
+	}
+	if r.unreadPos < r.unreadLen {
+		b := r.unreadBuf[r.unreadPos]
+		r.unreadPos++
+		return r.countByte(b, nil)
+	}
+	return r.countByte(r.brd.ReadByte())
+}
+
+// the maximum number of bytes that can be put back with unreadBytes
+const maxUnread = 3
+
+// unreadBytes puts back b, the last bytes read, so that they are decoded again.
+func (r *Reader) unreadBytes(b []byte) {
+	r.bytesRead -= int64(len(b))
+	if s := r.src; s != nil {
+		// fill keeps the last bytes in the buffer
+		s.pos -= len(b)
+		return
+	}
+	// if some of the bytes put back before are still unread, b has been read from the buffer as well,
+	// so the result fits
+	var buf [maxUnread]byte
+	n := copy(buf[:], b)
+	n += copy(buf[n:], r.unreadBuf[r.unreadPos:r.unreadLen])
+	r.unreadBuf, r.unreadPos, r.unreadLen = buf, 0, n
+}
+
+// brokenSurrogate is called when a high surrogate is not followed by a low one, next is the bytes read
+// after the high surrogate. In lenient mode they are put back, so that only the surrogate is replaced.
+func (r *Reader) brokenSurrogate(next []byte) error {
+	if r.opts.Lenient {
+		r.unreadBytes(next)
+	}
+	return ErrIllegalInput
+}
+
+// countByte accounts for a byte read from the underlying reader. The limit is only checked when there is
+// a byte, so that an input of exactly MaxInputBytes bytes ends with io.EOF.
+func (r *Reader) countByte(b byte, err error) (byte, error) {
 	if err == nil {
+		if r.bytesRead >= r.maxBytes {
+			return 0, ErrInputTooLarge
+		}
 		r.bytesRead++
 	}
 	return b, err
@@ -62,15 +318,24 @@ func (r *Reader) defineWindow(iWindow int, offset byte) error {
 	if offset == 0 {
 		return ErrIllegalInput
 	}
+	var newOffset int32
 	if offset < gapThreshold {
-		r.dynamicOffset[iWindow] = int32(offset) << 7
+		newOffset = int32(offset) << 7
 	} else if offset < reservedStart {
-		r.dynamicOffset[iWindow] = (int32(offset) << 7) + gapOffset
+		newOffset = (int32(offset) << 7) + gapOffset
 	} else if offset < fixedThreshold {
-		return fmt.Errorf("offset = %d", offset)
+		return fmt.Errorf("%w: reserved window offset %#x", ErrIllegalInput, offset)
 	} else {
-		r.dynamicOffset[iWindow] = fixedOffset[offset-fixedThreshold]
+		newOffset = fixedOffset[offset-fixedThreshold]
+	}
+	return r.setWindow(iWindow, newOffset)
+}
+
+func (r *Reader) setWindow(iWindow int, offset int32) error {
+	if r.opts.RejectRedundant && r.dynamicOffset[iWindow] == offset {
+		return fmt.Errorf("%w: window %d is already at %#x", ErrRedundantCommand, iWindow, offset)
 	}
+	r.dynamicOffset[iWindow] = offset
 
 	// make the redefined window the active one
 	r.window = iWindow
@@ -100,15 +365,13 @@ func (r *Reader) defineWindow(iWindow int, offset byte) error {
   The bottom 13 bits of chOffset are used to calculate the offset relative to
   a 7 bit input data byte to yield the 20 bits expressed by each surrogate pair.
   **/
-func (r *Reader) defineExtendedWindow(chOffset uint16) {
+func (r *Reader) defineExtendedWindow(chOffset uint16) error {
 	// The top 3 bits of iOffsetHi are the window index
 	window := chOffset >> 13
 
-	// Calculate the new offset
-	r.dynamicOffset[window] = ((int32(chOffset) & 0x1FFF) << 7) + (1 << 16)
-
-	// make the redefined window the active one
-	r.window = int(window)
+	// Calculate the new offset. The maximum is 0x1FFF<<7 + 0x10000 = 0x10FF80, so all characters
+	// in the window (up to U+10FFFF) are valid and no range check is needed.
+	return r.setWindow(int(window), ((int32(chOffset)&0x1FFF)<<7)+(1<<16))
 }
 
 // convert an io.EOF into io.ErrUnexpectedEOF
@@ -126,9 +389,16 @@ func (r *Reader) expandUnicode() (rune, error) {
 		if err != nil {
 			return 0, err
 		}
+		start := r.bytesRead - 1
+		if b >= UC0 && b <= UC7 || b >= UD0 && b <= UD7 || b == UDX {
+			if err := r.command(); err != nil {
+				return 0, err
+			}
+		}
 		if b >= UC0 && b <= UC7 {
 			r.window = int(b) - UC0
 			r.unicodeMode = false
+			r.report(CommandInfo{Offset: start, Tag: b, Window: r.window, WindowOffset: r.dynamicOffset[r.window], Char: -1})
 			return -1, nil
 		}
 		if b >= UD0 && b <= UD7 {
@@ -137,23 +407,48 @@ func (r *Reader) expandUnicode() (rune, error) {
 				return 0, unexpectedEOF(err)
 			}
 			r.unicodeMode = false
-			return -1, r.defineWindow(int(b)-UD0, b1)
+			if err := r.defineWindow(int(b)-UD0, b1); err != nil {
+				return 0, err
+			}
+			r.report(CommandInfo{Offset: start, Tag: b, Window: r.window, WindowOffset: r.dynamicOffset[r.window], Char: -1})
+			return -1, nil
 		}
 		if b == UDX {
 			c, err := r.readUint16()
 			if err != nil {
 				return 0, unexpectedEOF(err)
 			}
-			r.defineExtendedWindow(c)
 			r.unicodeMode = false
+			if err := r.defineExtendedWindow(c); err != nil {
+				return 0, err
+			}
+			r.report(CommandInfo{Offset: start, Tag: b, Window: r.window, WindowOffset: r.dynamicOffset[r.window], Char: -1})
 			return -1, nil
 		}
 		if b == UQU {
-			r, err := r.readUint16()
+			ch, err := r.readUint16()
 			if err != nil {
 				return 0, err
 			}
-			return rune(r), nil
+			if utf16.IsSurrogate(rune(ch)) {
+				if ch >= 0xDC00 {
+					// a lone low surrogate
+					return 0, ErrIllegalInput
+				}
+				// the low surrogate follows directly
+				lo, err := r.readUint16()
+				if err != nil {
+					return 0, err
+				}
+				c, err := combineSurrogates(rune(ch), rune(lo))
+				if err != nil {
+					return 0, r.brokenSurrogate([]byte{byte(lo >> 8), byte(lo)})
+				}
+				r.report(CommandInfo{Offset: start, Tag: b, Window: -1, Char: c})
+				return c, nil
+			}
+			r.report(CommandInfo{Offset: start, Tag: b, Window: -1, Char: rune(ch)})
+			return rune(ch), nil
 		} else {
 			b1, err := r.readByte()
 			if err != nil {
@@ -161,21 +456,33 @@ func (r *Reader) expandUnicode() (rune, error) {
 			}
 			ch := rune(uint16FromTwoBytes(b, b1))
 			if utf16.IsSurrogate(ch) {
+				if ch >= 0xDC00 {
+					// a lone low surrogate
+					return 0, ErrIllegalInput
+				}
 				ch1, err := r.readUint16()
 				if err != nil {
 					return 0, unexpectedEOF(err)
 				}
-				surrLo := rune(ch1)
-				if !utf16.IsSurrogate(surrLo) {
-					return 0, ErrIllegalInput
+				c, err := combineSurrogates(ch, rune(ch1))
+				if err != nil {
+					return 0, r.brokenSurrogate([]byte{byte(ch1 >> 8), byte(ch1)})
 				}
-				return utf16.DecodeRune(ch, surrLo), nil
+				return c, nil
 			}
 			return ch, nil
 		}
 	}
 }
 
+// combine a surrogate pair into a rune, returns ErrIllegalInput if hi and lo do not form a valid pair
+func combineSurrogates(hi, lo rune) (rune, error) {
+	if hi < 0xD800 || hi >= 0xDC00 || lo < 0xDC00 || lo > 0xDFFF {
+		return 0, ErrIllegalInput
+	}
+	return utf16.DecodeRune(hi, lo), nil
+}
+
 func (r *Reader) readUint16() (uint16, error) {
 	b1, err := r.readByte()
 	if err != nil {
@@ -199,14 +506,23 @@ func (r *Reader) expandSingleByte() (rune, error) {
 		if err != nil {
 			return 0, err
 		}
+		start := r.bytesRead - 1
 		staticWindow := 0
 		dynamicWindow := r.window
+		quoted := false
+
+		if b >= SD0 && b <= SD7 || b >= SC0 && b <= SC7 || b == SDX || b == SCU {
+			if err := r.command(); err != nil {
+				return 0, err
+			}
+		}
 
 		switch b {
 		case SQ0, SQ1, SQ2, SQ3, SQ4, SQ5, SQ6, SQ7:
 			// Select window pair to quote from
 			dynamicWindow = int(b) - SQ0
 			staticWindow = dynamicWindow
+			quoted = true
 			b, err = r.readByte()
 			if err != nil {
 				return 0, unexpectedEOF(err)
@@ -216,10 +532,21 @@ func (r *Reader) expandSingleByte() (rune, error) {
 			// output as character
 			if b < 0x80 {
 				// use static window
-				return int32(b) + staticOffset[staticWindow], nil
+				ch := int32(b) + staticOffset[staticWindow]
+				if quoted {
+					r.report(CommandInfo{Offset: start, Tag: byte(SQ0 + staticWindow), Window: staticWindow, WindowOffset: staticOffset[staticWindow], Char: ch})
+				}
+				return ch, nil
 			} else {
 				ch := int32(b) - 0x80
 				ch += r.dynamicOffset[dynamicWindow]
+				if !utf8.ValidRune(ch) {
+					// the window is positioned so that this byte maps outside of the Unicode range
+					return 0, ErrIllegalInput
+				}
+				if quoted {
+					r.report(CommandInfo{Offset: start, Tag: byte(SQ0 + dynamicWindow), Window: dynamicWindow, WindowOffset: r.dynamicOffset[dynamicWindow], Char: ch})
+				}
 				return ch, nil
 			}
 		case SDX:
@@ -228,7 +555,11 @@ func (r *Reader) expandSingleByte() (rune, error) {
 			if err != nil {
 				return 0, unexpectedEOF(err)
 			}
-			r.defineExtendedWindow(ch)
+			err = r.defineExtendedWindow(ch)
+			if err != nil {
+				return 0, err
+			}
+			r.report(CommandInfo{Offset: start, Tag: b, Window: r.window, WindowOffset: r.dynamicOffset[r.window], Char: -1})
 		case SD0, SD1, SD2, SD3, SD4, SD5, SD6, SD7:
 			// Position a dynamic Window
 			b1, err := r.readByte()
@@ -239,12 +570,18 @@ func (r *Reader) expandSingleByte() (rune, error) {
 			if err != nil {
 				return 0, err
 			}
+			r.report(CommandInfo{Offset: start, Tag: b, Window: r.window, WindowOffset: r.dynamicOffset[r.window], Char: -1})
 		case SC0, SC1, SC2, SC3, SC4, SC5, SC6, SC7:
 			// Select a new dynamic Window
+			if r.opts.RejectRedundant && r.window == int(b)-SC0 {
+				return 0, fmt.Errorf("%w: window %d is already active", ErrRedundantCommand, r.window)
+			}
 			r.window = int(b) - SC0
+			r.report(CommandInfo{Offset: start, Tag: b, Window: r.window, WindowOffset: r.dynamicOffset[r.window], Char: -1})
 		case SCU:
 			// switch to Unicode mode and continue parsing
 			r.unicodeMode = true
+			r.report(CommandInfo{Offset: start, Tag: b, Window: -1, Char: -1})
 			return -1, nil
 		case SQU:
 			// directly extract one Unicode character
@@ -252,14 +589,56 @@ func (r *Reader) expandSingleByte() (rune, error) {
 			if err != nil {
 				return 0, err
 			}
+			if utf16.IsSurrogate(rune(ch)) {
+				if ch >= 0xDC00 {
+					// a lone low surrogate
+					return 0, ErrIllegalInput
+				}
+				// a surrogate pair is quoted as two SQU sequences
+				b, err := r.readByte()
+				if err != nil {
+					return 0, unexpectedEOF(err)
+				}
+				if b != SQU {
+					return 0, r.brokenSurrogate([]byte{b})
+				}
+				lo, err := r.readUint16()
+				if err != nil {
+					return 0, err
+				}
+				c, err := combineSurrogates(rune(ch), rune(lo))
+				if err != nil {
+					return 0, r.brokenSurrogate([]byte{SQU, byte(lo >> 8), byte(lo)})
+				}
+				r.report(CommandInfo{Offset: start, Tag: SQU, Window: -1, Char: c})
+				return c, nil
+			}
+			r.report(CommandInfo{Offset: start, Tag: SQU, Window: -1, Char: rune(ch)})
 			return rune(ch), nil
 		case Srs:
+			if r.opts.TreatReservedAsLatin1 {
+				return rune(b), nil
+			}
 			return 0, ErrIllegalInput
 		}
+		if r.stopAfterCommand {
+			return -1, nil
+		}
 	}
 }
 
 func (r *Reader) readRune() (rune, error) {
+	r.canUnread = false
+	if r.unread {
+		r.unread = false
+		r.setState(r.after)
+		return r.lastRune, nil
+	}
+	start := r.bytesRead == 0
+	var initial scsu
+	if start {
+		initial = r.scsu
+	}
 	for {
 		var c rune
 		var err error
@@ -269,42 +648,302 @@ func (r *Reader) readRune() (rune, error) {
 			c, err = r.expandSingleByte()
 		}
 		if err != nil {
+			if errors.Is(err, ErrIllegalInput) {
+				if r.opts.Lenient {
+					return r.emit(r.opts.Replacement)
+				}
+				err = &DecodeError{Offset: r.bytesRead, Rune: r.runesRead, Err: err}
+			} else if errors.Is(err, ErrRedundantCommand) || errors.Is(err, ErrTooManyCommands) {
+				err = &DecodeError{Offset: r.bytesRead, Rune: r.runesRead, Err: err}
+			}
 			return 0, err
 		}
 		if c == -1 {
 			continue
 		}
-		return c, nil
+		if start && c == 0xFEFF && (r.opts.StripBOM || r.bytesRead == r.signatureLen() && r.scsu == initial) {
+			// a 3-byte sequence that doesn't change the state can only be SQU FE FF (or FE FF if the input
+			// starts in Unicode mode), skip the signature
+			start = false
+			continue
+		}
+		return r.emit(c)
+	}
+}
+
+// the length of the signature in the initial mode
+func (r *Reader) signatureLen() int64 {
+	if r.opts.InitialUnicodeMode {
+		return 2
 	}
+	return int64(len(signature))
+}
+
+// emit counts a decoded character (including replacements in lenient mode)
+func (r *Reader) emit(c rune) (rune, error) {
+	r.commands = 0
+	if r.runesRead++; r.opts.MaxRunes > 0 && r.runesRead > r.opts.MaxRunes {
+		return 0, ErrOutputTooLarge
+	}
+	return c, nil
 }
 
 // ReadRune reads a single SCSU encoded Unicode character
 // and returns the rune and the amount of bytes consumed. If no character is
 // available, err will be set.
+// The SCSU signature (U+FEFF quoted with SQU) at the very start of the input is skipped,
+// U+FEFF anywhere else is returned as is.
+//
+// If the input ends in the middle of a command or a character, io.ErrUnexpectedEOF is returned,
+// so that it can be distinguished from malformed input, which results in a *DecodeError wrapping
+// ErrIllegalInput. io.EOF is only returned if the input ends between the characters.
 func (r *Reader) ReadRune() (rune, int, error) {
-	pr := r.bytesRead
+	before := r.state()
 	c, err := r.readRune()
-	return c, r.bytesRead - pr, err
+	if err == nil {
+		r.last, r.lastRune, r.canUnread = before, c, true
+	}
+	return c, int(r.bytesRead - before.bytesRead), err
+}
+
+// UnreadRune implements io.RuneScanner. It un-reads the character returned by the last ReadRune, restoring
+// the decoder state (the windows, the mode and the number of bytes read) to the one before that call.
+// The character is returned by the next read operation. Only one level of un-reading is supported
+// (like in bufio.Reader): if the last operation was not a successful ReadRune (including when ReadRune
+// has not been called yet) ErrInvalidUnreadRune is returned.
+func (r *Reader) UnreadRune() error {
+	if !r.canUnread {
+		return ErrInvalidUnreadRune
+	}
+	r.canUnread = false
+	r.after = r.state()
+	r.setState(r.last)
+	r.unread = true
+	return nil
+}
+
+func (r *Reader) state() readerState {
+	return readerState{scsu: r.scsu, bytesRead: r.bytesRead, runesRead: r.runesRead, commands: r.commands}
+}
+
+func (r *Reader) setState(state readerState) {
+	r.scsu, r.bytesRead, r.runesRead, r.commands = state.scsu, state.bytesRead, state.runesRead, state.commands
+}
+
+// WindowState returns the current state of the decoder.
+func (r *Reader) WindowState() WindowState {
+	return r.windowState()
+}
+
+// ActiveWindow returns the currently active dynamic window. Note, in Unicode mode the window
+// is not used, but it remains active after switching back with UCn.
+func (r *Reader) ActiveWindow() Window {
+	return Window{index: r.window, offset: r.dynamicOffset[r.window]}
+}
+
+// BytesRead returns the total number of bytes consumed since the Reader was created or Reset.
+func (r *Reader) BytesRead() int64 {
+	return r.bytesRead
 }
 
 // ReadStringSizeHint is like ReadString, but takes a hint about the expected string size.
 // Note this is the size of the UTF-8 encoded string in bytes.
 func (r *Reader) ReadStringSizeHint(sizeHint int) (string, error) {
+	return r.readString(context.Background(), sizeHint)
+}
+
+// ReadStringContext is like ReadString, but stops and returns ctx.Err() if the context is done.
+// The context is checked periodically (every 1024 runes or consecutive commands) rather than for every rune.
+func (r *Reader) ReadStringContext(ctx context.Context) (string, error) {
+	return r.readString(ctx, 0)
+}
+
+// how many runes are decoded between the checks of the context
+const ctxCheckInterval = 1024
+
+// Buffers larger than this are not returned to stringBufPool so that a single large input
+// does not keep a lot of memory around.
+const maxPooledBufSize = 64 * 1024
+
+var stringBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+func (r *Reader) readString(ctx context.Context, sizeHint int) (string, error) {
 	var sb strings.Builder
-	if sizeHint > 0 {
+	if _, err := r.readStringInto(ctx, sizeHint, &sb); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// readStringInto decodes into a pooled buffer and then copies the result into sb, so that
+// the only allocation is the one made by sb. It returns the number of decoded runes.
+func (r *Reader) readStringInto(ctx context.Context, sizeHint int, sb *strings.Builder) (int, error) {
+	bp := stringBufPool.Get().(*[]byte)
+	buf := (*bp)[:0]
+	// If sb is empty, the output is copied into it whenever the buffer gets large, so that the buffer can be
+	// returned to the pool and a large input does not need a buffer as well as sb. In case of an
+	// error sb is reset.
+	direct := sb.Len() == 0
+	if direct && sizeHint > maxPooledBufSize {
 		sb.Grow(sizeHint)
+	} else if sizeHint > cap(buf) {
+		buf = make([]byte, 0, sizeHint)
 	}
-	for {
+	defer func() {
+		if cap(buf) <= maxPooledBufSize {
+			*bp = buf
+			stringBufPool.Put(bp)
+		}
+	}()
+	if ctx.Done() != nil {
+		r.ctx = ctx
+		defer func() {
+			r.ctx = nil
+		}()
+	}
+	fail := func(err error) (int, error) {
+		if direct {
+			sb.Reset()
+		}
+		return 0, err
+	}
+	n := 0
+	for nextCheck := ctxCheckInterval - 1; ; n++ {
+		if n >= nextCheck {
+			if err := ctx.Err(); err != nil {
+				return fail(err)
+			}
+			nextCheck = n + ctxCheckInterval
+		}
+		limit := math.MaxInt32
+		if direct {
+			if len(buf) > maxPooledBufSize-utf8.UTFMax {
+				sb.Write(buf)
+				buf = buf[:0]
+			}
+			limit = maxPooledBufSize - len(buf)
+		}
+		if r.asciiNext() {
+			var k int
+			buf, k = r.appendASCII(buf, limit)
+			n += k
+		}
 		r, err := r.readRune()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			return "", err
+			return fail(err)
 		}
-		sb.WriteRune(r)
+		buf = appendRune(buf, r)
 	}
-	return sb.String(), nil
+	sb.Grow(len(buf))
+	sb.Write(buf)
+	return n, nil
+}
+
+// asciiNext is a quick (inlinable) check whether the next byte is likely to be handled by appendASCII
+func (r *Reader) asciiNext() bool {
+	s := r.src
+	return s != nil && !r.unread && s.pos < len(s.b) && s.b[s.pos] >= 0x20 && s.b[s.pos] < 0x80
+}
+
+// appendASCII appends the bytes that are passed through in single byte mode (ASCII letters, NUL, CR, LF and TAB)
+// that follow in the input (at most max of them) to buf bypassing readRune. Returns the number of characters appended.
+func (r *Reader) appendASCII(buf []byte, max int) ([]byte, int) {
+	s := r.src
+	if s == nil || r.unicodeMode || r.bytesRead == 0 {
+		// the signature at the start is handled by readRune
+		return buf, 0
+	}
+	b := s.b[s.pos:]
+	if len(b) > max {
+		b = b[:max]
+	}
+	if limit := r.maxBytes - r.bytesRead; int64(len(b)) > limit {
+		b = b[:limit]
+	}
+	if r.opts.MaxRunes > 0 {
+		limit := r.opts.MaxRunes - r.runesRead
+		if limit < 0 {
+			limit = 0
+		}
+		if len(b) > limit {
+			b = b[:limit]
+		}
+	}
+	n := 0
+	for n < len(b) && isPassThrough(b[n]) {
+		n++
+	}
+	if n == 0 {
+		return buf, 0
+	}
+	buf = append(buf, b[:n]...)
+	s.pos += n
+	r.bytesRead += int64(n)
+	r.runesRead += n
+	r.commands = 0
+	return buf, n
+}
+
+// ReadStringInto is like ReadString but appends the decoded characters to sb.
+// In case of an error other than io.EOF sb is left unmodified.
+func (r *Reader) ReadStringInto(sb *strings.Builder) error {
+	_, err := r.readStringInto(context.Background(), 0, sb)
+	return err
+}
+
+// ReadStringCount is like ReadString but also returns the number of runes in the string.
+// In case of an error the count is 0.
+func (r *Reader) ReadStringCount() (string, int, error) {
+	var sb strings.Builder
+	n, err := r.readStringInto(context.Background(), 0, &sb)
+	if err != nil {
+		return "", 0, err
+	}
+	return sb.String(), n, nil
+}
+
+// ReadStringN is like ReadString but reads at most n bytes from the underlying reader, even if
+// there is more input available. This can be used to decode an SCSU message embedded in a larger stream
+// when the length of the message is known. If the limit splits a command or a character,
+// io.ErrUnexpectedEOF is returned. After a successful call the decoder state is preserved, so ReadStringN can be called
+// again to decode the following bytes as a continuation.
+func (r *Reader) ReadStringN(n int) (string, error) {
+	brd, src := r.brd, r.src
+	r.setByteReader(&limitedByteReader{r: brd, n: n})
+	defer func() {
+		r.brd, r.src = brd, src
+		if src != nil && r.unreadPos < r.unreadLen {
+			// the bytes put back while reading through limitedByteReader came from src
+			src.pos -= r.unreadLen - r.unreadPos
+			r.unreadPos = r.unreadLen
+		}
+	}()
+	return r.readString(context.Background(), 0)
+}
+
+// limitedByteReader is like io.LimitedReader but for io.ByteReader
+type limitedByteReader struct {
+	r io.ByteReader
+	n int
+}
+
+func (l *limitedByteReader) ReadByte() (byte, error) {
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+	b, err := l.r.ReadByte()
+	if err == nil {
+		l.n--
+	}
+	return b, err
 }
 
 // ReadString reads all available input as a string.
@@ -314,13 +953,511 @@ func (r *Reader) ReadString() (string, error) {
 	return r.ReadStringSizeHint(0)
 }
 
+// Read implements io.Reader. It decodes the input and writes it into p as UTF-8.
+// If p is too small to fit the next rune, the remaining bytes are retained and
+// returned by subsequent calls so that the output as a whole is a valid UTF-8 sequence.
+func (r *Reader) Read(p []byte) (n int, err error) {
+	if r.pendingPos < r.pendingLen {
+		n = copy(p, r.pending[r.pendingPos:r.pendingLen])
+		r.pendingPos += n
+		if r.pendingPos < r.pendingLen {
+			return
+		}
+	}
+	if r.readErr != nil {
+		err = r.readErr
+		if n > 0 {
+			err = nil
+		}
+		return
+	}
+	for n < len(p) {
+		c, err := r.readRune()
+		if err != nil {
+			r.readErr = err
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if size := utf8.RuneLen(c); size > 0 && n+size <= len(p) {
+			n += utf8.EncodeRune(p[n:], c)
+		} else {
+			r.pendingLen = utf8.EncodeRune(r.pending[:], c)
+			r.pendingPos = copy(p[n:], r.pending[:r.pendingLen])
+			n += r.pendingPos
+		}
+	}
+	return
+}
+
+// WriteTo implements io.WriterTo. It decodes the input until io.EOF or an error occurs
+// and writes the result as UTF-8 into w. In case of a decoding error, the valid prefix is
+// written before the error is returned.
+func (r *Reader) WriteTo(w io.Writer) (n int64, err error) {
+	var buf [512]byte
+	b := append(buf[:0], r.pending[r.pendingPos:r.pendingLen]...)
+	r.pendingPos = r.pendingLen
+	for r.readErr == nil {
+		c, err := r.readRune()
+		if err != nil {
+			r.readErr = err
+			break
+		}
+		b = appendRune(b, c)
+		if len(b) > len(buf)-utf8.UTFMax {
+			written, err := w.Write(b)
+			n += int64(written)
+			if err != nil {
+				return n, err
+			}
+			b = b[:0]
+		}
+	}
+	if len(b) > 0 {
+		written, err := w.Write(b)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	if r.readErr != io.EOF {
+		err = r.readErr
+	}
+	return
+}
+
+// DecodeChunk decodes the characters in chunk and appends the resulting UTF-8 to dst. It can be used when
+// the input arrives in arbitrary pieces (e.g. from a socket). If chunk ends with an incomplete command or
+// character, the decoder state is rolled back to before it, the incomplete bytes are retained and ErrNeedMore
+// is returned along with the characters decoded so far. The retained bytes are prepended to the next chunk,
+// so the caller only needs to pass the new data, which can be empty. If the input has ended and the last call
+// returned ErrNeedMore, the input is truncated.
+// DecodeChunk does not use the underlying io.ByteReader, it should not be mixed with the other reading methods
+// unless the Reader is Reset.
+func (r *Reader) DecodeChunk(dst, chunk []byte) ([]byte, error) {
+	data := chunk
+	if len(r.chunkTail) > 0 {
+		data = append(r.chunkTail, chunk...)
+	}
+	brd, src := r.brd, r.src
+	in := sliceByteReader{b: data}
+	r.setByteReader(&in)
+	defer func() {
+		r.brd, r.src = brd, src
+	}()
+	for {
+		pos, state := in.pos, r.state()
+		c, err := r.readRune()
+		if err != nil {
+			if err == io.EOF {
+				r.chunkTail = r.chunkTail[:0]
+				return dst, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				r.setState(state)
+				// data may share the backing array with chunkTail
+				r.chunkTail = append(r.chunkTail[:0], data[pos:]...)
+				return dst, ErrNeedMore
+			}
+			return dst, err
+		}
+		dst = appendRune(dst, c)
+	}
+}
+
+// Clone returns a copy of the Reader with the same decoder state (the windows, the mode, the counters, a pending
+// UnreadRune, the incomplete sequence retained by DecodeChunk), the options and the OnCommand callback, so that
+// decoding can continue from the current point in two independent branches, for example for backtracking in a parser.
+// The position in the underlying reader cannot be cloned in general. If the Reader reads from a *bytes.Reader or
+// a *strings.Reader (including NewReaderString), the copy gets its own copy of it positioned at the same byte, so the
+// two Readers are fully independent. Otherwise the underlying reader is shared and reading from one of the Readers
+// advances the other one as well, so the caller has to make sure the copy reads from the right position (e.g. by
+// calling Reset with a reader positioned accordingly).
+func (r *Reader) Clone() *Reader {
+	c := *r
+	c.chunkTail = append([]byte(nil), r.chunkTail...)
+	switch brd := r.brd.(type) {
+	case *sliceByteReader:
+		if brd.rd == nil {
+			src := *brd
+			c.setByteReader(&src)
+		}
+	case *bytes.Reader:
+		src := *brd
+		c.setByteReader(&src)
+	case *strings.Reader:
+		src := *brd
+		c.setByteReader(&src)
+	}
+	return &c
+}
+
+// OnCommand registers a function that is called for each successfully decoded command: a window selection
+// or definition, a mode switch or a quoted character. The function is called after the command has been applied,
+// but before the resulting character (if any) is returned. This is intended for debugging and visualisation tools,
+// it does not affect decoding. Passing nil removes the callback. The callback is kept by Reset.
+// Note, DecodeChunk re-decodes an incomplete sequence at the end of a chunk when the next chunk arrives,
+// so the commands in it may be reported more than once.
+func (r *Reader) OnCommand(f func(CommandInfo)) {
+	r.onCommand = f
+}
+
+func (r *Reader) report(info CommandInfo) {
+	if r.onCommand != nil {
+		r.onCommand(info)
+	}
+}
+
+// ResetWindows resets the windows and the mode to the initial state without affecting the underlying
+// reader or the number of bytes read. This can be used when the input consists of
+// independently encoded segments.
+func (r *Reader) ResetWindows() {
+	r.reset()
+	r.init()
+}
+
+// Reset discards the reader's state and makes it equivalent to the result of NewReader
+// called with rd allowing to re-use the instance.
 func (r *Reader) Reset(rd io.ByteReader) {
-	r.brd, r.bytesRead = rd, 0
+	r.setByteReader(rd)
+	r.bytesRead, r.runesRead, r.commands = 0, 0, 0
+	r.pendingPos, r.pendingLen, r.readErr = 0, 0, nil
+	r.unreadPos, r.unreadLen = 0, 0
+	r.chunkTail = r.chunkTail[:0]
+	r.canUnread, r.unread = false, false
 	r.reset()
 	r.init()
 }
 
+// the size of the buffer used by NewReaderFrom
+const readAheadSize = 4096
+
+// sliceByteReader reads bytes from a slice. If rd is set, the slice is refilled from it
+// (up to its capacity) once it's exhausted.
+type sliceByteReader struct {
+	b   []byte
+	pos int
+	rd  io.Reader
+	err error // the error returned by rd
+}
+
+func (s *sliceByteReader) ReadByte() (byte, error) {
+	if s.pos < len(s.b) {
+		b := s.b[s.pos]
+		s.pos++
+		return b, nil
+	}
+	if s.rd != nil {
+		return s.fill()
+	}
+	return 0, io.EOF
+}
+
+func (s *sliceByteReader) fill() (byte, error) {
+	// keep the last bytes, so that they can be put back by Reader.unreadBytes
+	keep := len(s.b)
+	if keep > maxUnread {
+		keep = maxUnread
+	}
+	copy(s.b, s.b[len(s.b)-keep:])
+	s.b, s.pos = s.b[:keep], keep
+	for i := 0; s.err == nil; i++ {
+		if i == 100 {
+			return 0, io.ErrNoProgress
+		}
+		var n int
+		n, s.err = s.rd.Read(s.b[keep:cap(s.b)])
+		if n > 0 {
+			s.b, s.pos = s.b[:keep+n], keep+1
+			return s.b[keep], nil
+		}
+	}
+	return 0, s.err
+}
+
 // Decode a byte array as a string.
 func Decode(b []byte) (string, error) {
-	return NewReader(bytes.NewBuffer(b)).ReadStringSizeHint(len(b))
+	var r Reader
+	r.Reset(&sliceByteReader{b: b})
+	return r.ReadStringSizeHint(len(b))
+}
+
+// DecodeWithInitialWindow decodes b produced by EncodeWithInitialWindow with the same iWindow and offset.
+// It panics if iWindow or offset is out of range.
+func DecodeWithInitialWindow(b []byte, iWindow int, offset byte) (string, error) {
+	return NewReaderWithOptions(&sliceByteReader{b: b}, DecoderOptions{
+		InitialWindows:      initialWindow(iWindow, offset),
+		InitialActiveWindow: iWindow,
+	}).ReadStringSizeHint(len(b))
+}
+
+// DecodeString is like Decode but accepts a string, avoiding a copy of the input.
+func DecodeString(s string) (string, error) {
+	return NewReaderString(s).ReadStringSizeHint(len(s))
+}
+
+// DecodeTo decodes b and writes the resulting UTF-8 into w, returning the number of bytes written.
+// If b contains an illegal sequence, the characters preceding it are written and the error is returned.
+func DecodeTo(w io.Writer, b []byte) (int, error) {
+	var r Reader
+	r.Reset(&sliceByteReader{b: b})
+	n, err := r.WriteTo(w)
+	return int(n), err
+}
+
+// DecodeBytes is like Decode but returns the decoded UTF-8 as []byte.
+func DecodeBytes(b []byte) ([]byte, error) {
+	out, err := AppendDecode(make([]byte, 0, len(b)), b)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DecodeRunes is like Decode but returns the decoded characters as []rune. Because each character
+// takes at least one byte, the result is allocated only once.
+func DecodeRunes(b []byte) ([]rune, error) {
+	var r Reader
+	r.Reset(&sliceByteReader{b: b})
+	out := make([]rune, 0, len(b))
+	for {
+		c, err := r.readRune()
+		if err != nil {
+			if err == io.EOF {
+				return out, nil
+			}
+			return nil, err
+		}
+		out = append(out, c)
+	}
+}
+
+// AppendDecode decodes src and appends the resulting UTF-8 to dst. If dst does not have enough capacity
+// it will be re-allocated. It can be nil.
+// In case of an error dst is returned unmodified.
+func AppendDecode(dst, src []byte) ([]byte, error) {
+	var r Reader
+	r.Reset(&sliceByteReader{b: src})
+	n := len(dst)
+	for {
+		if r.asciiNext() {
+			dst, _ = r.appendASCII(dst, len(src))
+		}
+		c, err := r.readRune()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return dst, nil
+			}
+			return dst[:n], err
+		}
+		dst = appendRune(dst, c)
+	}
+}
+
+func appendRune(b []byte, r rune) []byte {
+	if r >= 0 && r < utf8.RuneSelf {
+		return append(b, byte(r))
+	}
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	return append(b, buf[:n]...)
+}
+
+// DecodeRune decodes the first character in b and returns it along with the number of bytes consumed.
+// Each call starts from the initial state (i.e. default windows and single byte mode), so the result
+// is only meaningful if b is an independently encoded character or the start of an SCSU stream.
+// If b is empty, io.EOF is returned.
+func DecodeRune(b []byte) (rune, int, error) {
+	var r Reader
+	r.Reset(&sliceByteReader{b: b})
+	return r.ReadRune()
+}
+
+// LooksLikeSCSU reports whether b is more likely to be SCSU than UTF-8. It's a heuristic: b is considered
+// SCSU if it starts with the SCSU signature, or if it is a valid SCSU stream that either contains
+// command bytes (which are rarely used control characters in UTF-8) or is not a valid UTF-8.
+// Because ASCII text (without control characters other than NUL, TAB, CR and LF) is the same
+// in both encodings, it's reported as UTF-8. Valid UTF-8 that happens to be valid SCSU without commands
+// is reported as UTF-8 as well, while UTF-8 text containing control characters may be reported as SCSU.
+func LooksLikeSCSU(b []byte) bool {
+	if bytes.HasPrefix(b, signature[:]) {
+		return true
+	}
+	if !Valid(b) {
+		return false
+	}
+	for _, c := range b {
+		if c < 0x20 && !isPassThrough(c) {
+			return true
+		}
+	}
+	return !utf8.Valid(b)
+}
+
+// Valid reports whether b is a valid SCSU stream, i.e. it can be decoded without errors.
+func Valid(b []byte) bool {
+	return validate(b) == nil
+}
+
+// validate returns the error Decode would return for b
+func validate(b []byte) error {
+	var r Reader
+	r.Reset(&sliceByteReader{b: b})
+	for {
+		if _, err := r.readRune(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// SplitStreams splits b that consists of independently encoded SCSU streams concatenated together, each
+// starting with the SCSU signature (e.g. produced with EncoderOptions.Signature). The returned slices share the
+// memory with b, each of them (apart from possibly the first one, if b does not start with the signature) includes
+// the signature and can be decoded with Decode.
+// A stream begins wherever the signature bytes follow a complete command or character of the previous stream
+// in single byte mode, so U+FEFF quoted with SQU inside a stream is considered to be the start of a new one.
+// In Unicode mode the same bytes are a part of a character, so a stream that ends in Unicode mode cannot be
+// followed by another one. If one of the streams
+// cannot be decoded, the error is returned (the offset in a *DecodeError is relative to b).
+func SplitStreams(b []byte) ([][]byte, error) {
+	var streams [][]byte
+	var r Reader
+	src := sliceByteReader{b: b}
+	r.Reset(&src)
+	start, runes := 0, 0
+	for src.pos < len(b) {
+		if src.pos > start && !r.unicodeMode && bytes.HasPrefix(b[src.pos:], signature[:]) {
+			// the signature follows a complete command or character, start the next stream
+			streams = append(streams, b[start:src.pos])
+			start, runes = src.pos, 0
+			r.Reset(&src)
+		}
+		var c rune
+		var err error
+		if r.unicodeMode {
+			c, err = r.expandUnicode()
+		} else {
+			c, err = r.expandSingleByte()
+		}
+		if err != nil {
+			if errors.Is(err, ErrIllegalInput) {
+				err = &DecodeError{Offset: int64(src.pos), Rune: runes, Err: err}
+			}
+			return nil, err
+		}
+		// the leading signature is not counted, like in Decode
+		if c != -1 && (src.pos-start != len(signature) || !bytes.HasPrefix(b[start:], signature[:])) {
+			runes++
+		}
+	}
+	if start < len(b) {
+		streams = append(streams, b[start:])
+	}
+	return streams, nil
+}
+
+// DecodedLen returns the length in bytes of the UTF-8 representation of the decoded b
+// without producing the output. It returns the same errors as Decode would.
+func DecodedLen(b []byte) (int, error) {
+	var r Reader
+	r.Reset(&sliceByteReader{b: b})
+	n := 0
+	for {
+		c, err := r.readRune()
+		if err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return 0, err
+		}
+		if size := utf8.RuneLen(c); size > 0 {
+			n += size
+		} else {
+			n += len(string(utf8.RuneError))
+		}
+	}
+}
+
+// RecordDecoder decodes a stream of SCSU records separated by a delimiter byte, such as '\n'. Each record
+// is decoded independently, starting from the initial state (default windows and single byte mode).
+// The delimiter is only recognised where a command or a character starts, so it can appear as an argument
+// of a command (e.g. Encode("\u050A") produces SD3 0A 8A) or inside a Unicode mode character. However, in
+// Unicode mode the delimiter cannot be told apart from the first byte of a character (for '\n' these are
+// U+0A00-U+0AFF), in which case it is taken for the end of the record.
+type RecordDecoder struct {
+	br    *bufio.Reader
+	delim byte
+	buf   []byte
+	rd    Reader
+}
+
+// NewRecordDecoder returns a RecordDecoder that reads records from r.
+func NewRecordDecoder(r io.Reader, delim byte) *RecordDecoder {
+	d := &RecordDecoder{
+		br:    bufio.NewReader(r),
+		delim: delim,
+	}
+	d.rd.stopAfterCommand = true
+	return d
+}
+
+// Next decodes the next record. The delimiter is not included in the result. If the input ends without
+// a delimiter, the remaining bytes are decoded as the last record, a delimiter at the very end of the input
+// does not start a new (empty) record. Once there are no more records, io.EOF is returned.
+// If a record cannot be decoded, the error is returned and the following record can still be read.
+func (d *RecordDecoder) Next() (string, error) {
+	d.buf = d.buf[:0]
+	d.rd.Reset(d.br)
+	initial := d.rd.scsu
+	runes := 0
+	for {
+		b, err := d.br.ReadByte()
+		if err != nil {
+			if err == io.EOF && d.rd.bytesRead > 0 {
+				break
+			}
+			return "", err
+		}
+		if b == d.delim {
+			break
+		}
+		_ = d.br.UnreadByte()
+		var c rune
+		if d.rd.unicodeMode {
+			c, err = d.rd.expandUnicode()
+		} else {
+			c, err = d.rd.expandSingleByte()
+		}
+		if err != nil {
+			if errors.Is(err, ErrIllegalInput) {
+				err = &DecodeError{Offset: d.rd.bytesRead, Rune: runes, Err: err}
+			}
+			d.skip()
+			return "", err
+		}
+		if c == -1 {
+			continue
+		}
+		if runes == 0 && c == 0xFEFF && d.rd.bytesRead == int64(len(signature)) && d.rd.scsu == initial {
+			// skip the signature, like Reader does
+			continue
+		}
+		d.buf = appendRune(d.buf, c)
+		runes++
+	}
+	return string(d.buf), nil
+}
+
+// skip discards the rest of the current record including the delimiter
+func (d *RecordDecoder) skip() {
+	for {
+		_, err := d.br.ReadSlice(d.delim)
+		if err != bufio.ErrBufferFull {
+			return
+		}
+	}
 }
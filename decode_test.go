@@ -1,8 +1,18 @@
 package scsu
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"unicode/utf8"
 )
 
 var (
@@ -74,3 +84,1587 @@ func BenchmarkDecode(b *testing.B) {
 		_, _ = Decode(refEncoded)
 	}
 }
+
+func TestRead(t *testing.T) {
+	for _, size := range []int{1, 2, 3, 5, 64} {
+		d := NewReader(bytes.NewBuffer(refEncoded))
+		var out bytes.Buffer
+		buf := make([]byte, size)
+		for {
+			n, err := d.Read(buf)
+			out.Write(buf[:n])
+			if err != nil {
+				if err != io.EOF {
+					t.Fatal(err)
+				}
+				break
+			}
+		}
+		if out.String() != referenceString {
+			t.Fatalf("size %d: %s", size, out.String())
+		}
+	}
+}
+
+func TestReadError(t *testing.T) {
+	d := NewReader(bytes.NewBuffer([]byte{0x12, 0x9C, 0xBE, Srs}))
+	b, err := ioutil.ReadAll(d)
+	if !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(b) != "Мо" {
+		t.Fatalf("Unexpected output: %s", b)
+	}
+}
+
+func TestReaderReset(t *testing.T) {
+	d := NewReader(bytes.NewBuffer(refEncoded))
+	// leave the reader in the middle of the input with non-default windows and Unicode mode
+	for i := 0; i < 10; i++ {
+		if _, _, err := d.ReadRune(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Reset(bytes.NewBuffer([]byte{0x12, 0x9C, 0xBE, 0xC1, 0xBA, 0xB2, 0xB0}))
+	r, n, err := d.ReadRune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 'М' || n != 2 {
+		t.Fatalf("Unexpected rune: %c, size: %d", r, n)
+	}
+	s, err := d.ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "осква" {
+		t.Fatal(s)
+	}
+}
+
+func TestDecodeQuotedSurrogates(t *testing.T) {
+	for _, input := range [][]byte{
+		{SQU, 0xD8, 0x3D, SQU, 0xDE, 0x00},
+		{SCU, UQU, 0xD8, 0x3D, 0xDE, 0x00},
+		{SCU, 0xD8, 0x3D, 0xDE, 0x00},
+	} {
+		s, err := Decode(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != "😀" {
+			t.Fatalf("%v: %q", input, s)
+		}
+	}
+
+	for _, input := range [][]byte{
+		{SQU, 0xD8, 0x3D, 0x41},
+		{SQU, 0xD8, 0x3D, SQU, 0x00, 0x41},
+		{SQU, 0xDE, 0x00},
+		{SQU, 0xDE, 0x00, SQU, 0xD8, 0x3D},
+		{SCU, UQU, 0xD8, 0x3D, 0x00, 0x41},
+		{SCU, UQU, 0xDE, 0x00, 0xD8, 0x3D},
+	} {
+		_, err := Decode(input)
+		if !errors.Is(err, ErrIllegalInput) {
+			t.Fatalf("%v: unexpected error: %v", input, err)
+		}
+	}
+}
+
+func TestDecodeRuneRange(t *testing.T) {
+	// the highest extended window
+	s, err := Decode([]byte{SDX, 0xFF, 0xFF, 0xFF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "\U0010FFFF" {
+		t.Fatalf("%q", s)
+	}
+
+	d := NewReader(bytes.NewBuffer([]byte{0x41, 0x90}))
+	d.dynamicOffset[0] = 0x10FFF0
+	_, err = d.ReadString()
+	if !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	d = NewReader(bytes.NewBuffer([]byte{0x90}))
+	d.dynamicOffset[0] = 0xD7F0
+	_, err = d.ReadString()
+	if !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	_, err := Decode([]byte{0x12, 0x9C, 0xBE, Srs, 0xC1})
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decodeErr.Offset != 4 {
+		t.Fatalf("Unexpected offset: %d", decodeErr.Offset)
+	}
+	if decodeErr.Rune != 2 {
+		t.Fatalf("Unexpected rune index: %d", decodeErr.Rune)
+	}
+	if !errors.Is(err, ErrIllegalInput) {
+		t.Fatal("Not ErrIllegalInput")
+	}
+	if err.Error() != "illegal input at offset 4" {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestDecodeLenient(t *testing.T) {
+	input := []byte{
+		0x12, 0x9C, 0xBE, // Мо
+		Srs,
+		0xC1, 0xBA, // ск
+		SQU, 0xDE, 0x00, // a lone low surrogate
+		SD1, 0x00, // a reserved window offset
+		0xB2, 0xB0, // ва
+		SCU, 0xD8, 0x3D, 0x00, 0x41, // a broken surrogate pair
+		0x04, 0x1C, // М
+	}
+	_, err := Decode(input)
+	if !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s, err := NewReaderWithOptions(bytes.NewBuffer(input), DecoderOptions{Lenient: true}).ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "Мо�ск��ва�AМ" {
+		t.Fatal(s)
+	}
+}
+
+func TestDecodeLenientBrokenSurrogate(t *testing.T) {
+	tests := []struct {
+		input []byte
+		s     string
+	}{
+		{[]byte{SCU, 0xD8, 0x3D, 0x00, 0x41}, "\uFFFDA"},
+		{[]byte{SCU, 0xD8, 0x3D, 0xD8, 0x3D, 0xDE, 0x00}, "\uFFFD\U0001F600"},
+		{[]byte{SCU, 0xD8, 0x3D, UC0, 'a'}, "\uFFFDa"},
+		{[]byte{SCU, UQU, 0xD8, 0x3D, 0x00, 0x41}, "\uFFFDA"},
+		{[]byte{SQU, 0xD8, 0x3D, 'a', 'b'}, "\uFFFDab"},
+		{[]byte{SQU, 0xD8, 0x3D, SQU, 0x00, 0x41, 'b'}, "\uFFFDAb"},
+		{[]byte{SQU, 0xD8, 0x3D, SQU, 0xD8, 0x3D, SQU, 0xDE, 0x00}, "\uFFFD\U0001F600"},
+	}
+	opts := DecoderOptions{Lenient: true}
+	for _, test := range tests {
+		readers := map[string]io.ByteReader{
+			"buffer": bytes.NewBuffer(test.input),
+			"slice":  &sliceByteReader{b: test.input},
+			"refill": &sliceByteReader{b: make([]byte, 0, 4), rd: iotest.OneByteReader(bytes.NewReader(test.input))},
+		}
+		for name, rd := range readers {
+			s, err := NewReaderWithOptions(rd, opts).ReadString()
+			if err != nil {
+				t.Fatalf("%x (%s): %v", test.input, name, err)
+			}
+			if s != test.s {
+				t.Fatalf("%x (%s): %q", test.input, name, s)
+			}
+		}
+		r := NewReaderWithOptions(nil, opts)
+		var out []byte
+		for i := range test.input {
+			var err error
+			out, err = r.DecodeChunk(out, test.input[i:i+1])
+			if err != nil && err != ErrNeedMore {
+				t.Fatal(err)
+			}
+		}
+		if string(out) != test.s {
+			t.Fatalf("%x (DecodeChunk): %q", test.input, out)
+		}
+	}
+}
+
+func TestNewReaderFrom(t *testing.T) {
+	s, err := NewReaderFrom(iotest.OneByteReader(bytes.NewReader(refEncoded))).ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != referenceString {
+		t.Fatal(s)
+	}
+
+	// larger than the read-ahead buffer
+	input := bytes.Repeat(refEncoded, readAheadSize/len(refEncoded)*3)
+	r := NewReaderFrom(iotest.HalfReader(bytes.NewReader(input)))
+	s, err = r.ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != strings.Repeat(referenceString, readAheadSize/len(refEncoded)*3) || r.BytesRead() != int64(len(input)) {
+		t.Fatal("Content does not match")
+	}
+
+	_, err = NewReaderFrom(iotest.TimeoutReader(bytes.NewReader(input))).ReadString()
+	if err != iotest.ErrTimeout {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// cancelReader cancels the context after n bytes have been read.
+type cancelReader struct {
+	n      int
+	cancel func()
+}
+
+func (r *cancelReader) ReadByte() (byte, error) {
+	r.n--
+	if r.n == 0 {
+		r.cancel()
+	}
+	return 'a', nil
+}
+
+func TestReadStringContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := NewReader(&cancelReader{n: 100000, cancel: cancel}).ReadStringContext(ctx)
+	if err != context.Canceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// a long run of commands without characters
+	toggles := append([]byte{'a'}, bytes.Repeat([]byte{SCU, UC0}, 100000)...)
+	_, err = NewReader(bytes.NewReader(toggles)).ReadStringContext(ctx)
+	if err != context.Canceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	s, err := NewReader(bytes.NewBuffer(refEncoded)).ReadStringContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != referenceString {
+		t.Fatal(s)
+	}
+}
+
+func TestAppendDecode(t *testing.T) {
+	buf := []byte("head")
+	buf, err := AppendDecode(buf, refEncoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "head"+referenceString {
+		t.Fatal(string(buf))
+	}
+
+	buf, err = AppendDecode(buf[:4], []byte{0x12, 0x9C, Srs})
+	if !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(buf) != "head" {
+		t.Fatal(string(buf))
+	}
+}
+
+func BenchmarkAppendDecode(b *testing.B) {
+	b.ReportAllocs()
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf, _ = AppendDecode(buf[:0], refEncoded)
+	}
+}
+
+func TestDecodeSignature(t *testing.T) {
+	for _, tc := range []struct {
+		input    []byte
+		expected string
+	}{
+		{[]byte{SQU, 0xFE, 0xFF, 0x12, 0x9C, 0xBE}, "Мо"},
+		{[]byte{SQU, 0xFE, 0xFF}, ""},
+		{[]byte{0x12, 0x9C, 0xBE}, "Мо"},
+		{[]byte{0x12, 0x9C, SQU, 0xFE, 0xFF, 0xBE}, "М\uFEFFо"},
+		{[]byte{SQU, 0xFE, 0xFF, SQU, 0xFE, 0xFF}, "\uFEFF"},
+		{[]byte{SD3, 0xA5, 0xFF}, "\uFEFF"},
+		{[]byte{SCU, 0xFE, 0xFF}, "\uFEFF"},
+	} {
+		s, err := Decode(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != tc.expected {
+			t.Fatalf("%v: %q", tc.input, s)
+		}
+	}
+}
+
+func TestDecodeStripBOM(t *testing.T) {
+	for _, tc := range []struct {
+		input    []byte
+		expected string
+	}{
+		{[]byte{SQU, 0xFE, 0xFF, 0x12, 0x9C, 0xBE}, "Мо"},
+		{[]byte{SQU, 0xFE, 0xFF, SQU, 0xFE, 0xFF}, "\uFEFF"},
+		{[]byte{SCU, 0xFE, 0xFF, 0x04, 0x1C}, "М"},
+		{[]byte{SD3, 0xA5, 0xFF, 0xFF}, "\uFEFF"},
+		{[]byte{0x12, 0x9C, SQU, 0xFE, 0xFF, 0xBE}, "М\uFEFFо"},
+	} {
+		s, err := NewReaderWithOptions(bytes.NewBuffer(tc.input), DecoderOptions{StripBOM: true}).ReadString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != tc.expected {
+			t.Fatalf("%v: %q", tc.input, s)
+		}
+	}
+}
+
+func TestDecodeRune(t *testing.T) {
+	for _, tc := range []struct {
+		input    []byte
+		expected rune
+		size     int
+	}{
+		{[]byte{0x12, 0x9C, 0xBE}, 'М', 2},
+		{[]byte{'a', 'b'}, 'a', 1},
+		{[]byte{SCU, 0xD8, 0x3D, 0xDE, 0x00, 0x00, 0x41}, '😀', 5},
+		{[]byte{SQU, 0x5C, 0x71}, '山', 3},
+	} {
+		r, size, err := DecodeRune(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != tc.expected || size != tc.size {
+			t.Fatalf("%v: %c, %d", tc.input, r, size)
+		}
+	}
+	if _, _, err := DecodeRune(nil); err != io.EOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err := DecodeRune([]byte{SD0}); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestDecodeBytes(t *testing.T) {
+	b, err := DecodeBytes(refEncoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != referenceString {
+		t.Fatal(string(b))
+	}
+	b, err = DecodeBytes([]byte{0x12, 0x9C, Srs})
+	if !errors.Is(err, ErrIllegalInput) || b != nil {
+		t.Fatalf("Unexpected result: %v, %v", b, err)
+	}
+}
+
+func TestDecodeRunes(t *testing.T) {
+	runes, err := DecodeRunes(refEncoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(runes) != referenceString {
+		t.Fatal(string(runes))
+	}
+	runes, err = DecodeRunes([]byte{0x12, 0x9C, Srs})
+	if !errors.Is(err, ErrIllegalInput) || runes != nil {
+		t.Fatalf("Unexpected result: %v, %v", runes, err)
+	}
+	runes, err = DecodeRunes(nil)
+	if err != nil || len(runes) != 0 {
+		t.Fatalf("Unexpected result: %v, %v", runes, err)
+	}
+}
+
+func BenchmarkDecodeBytes(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = DecodeBytes(refEncoded)
+	}
+}
+
+func BenchmarkDecodeToBytes(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s, _ := Decode(refEncoded)
+		_ = []byte(s)
+	}
+}
+
+// infiniteReader yields the same byte forever.
+type infiniteReader byte
+
+func (r infiniteReader) ReadByte() (byte, error) {
+	return byte(r), nil
+}
+
+func TestDecodeMaxRunes(t *testing.T) {
+	_, err := NewReaderWithOptions(infiniteReader(0x9C), DecoderOptions{MaxRunes: 1 << 20}).ReadString()
+	if err != ErrOutputTooLarge {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	d := NewReaderWithOptions(bytes.NewBuffer([]byte{0x12, 0x9C, 0xBE, 0xC1, 0xBA, 0xB2, 0xB0}), DecoderOptions{MaxRunes: 6})
+	s, err := d.ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "Москва" {
+		t.Fatal(s)
+	}
+	d.Reset(bytes.NewBuffer([]byte{0x12, 0x9C, 0xBE, 0xC1, 0xBA, 0xB2, 0xB0, 0xB0}))
+	if _, err = d.ReadString(); err != ErrOutputTooLarge {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestBytesRead(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0x12, 0x9C, 0xBE, SC0, 'x', 'y'})
+	d := NewReader(buf)
+	for i := 0; i < 2; i++ {
+		if _, _, err := d.ReadRune(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := d.BytesRead(); n != 3 {
+		t.Fatalf("Unexpected BytesRead: %d", n)
+	}
+	if r, _, err := d.ReadRune(); err != nil || r != 'x' {
+		t.Fatalf("Unexpected result: %c, %v", r, err)
+	}
+	if n := d.BytesRead(); n != 5 {
+		t.Fatalf("Unexpected BytesRead: %d", n)
+	}
+	if buf.String() != "y" {
+		t.Fatalf("Unexpected remaining input: %q", buf.String())
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	var out bytes.Buffer
+	n, err := io.Copy(&out, NewReader(bytes.NewBuffer(bytes.Repeat(refEncoded, 10))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != strings.Repeat(referenceString, 10) || n != int64(out.Len()) {
+		t.Fatalf("Unexpected result: %d, %s", n, out.String())
+	}
+
+	out.Reset()
+	d := NewReader(bytes.NewBuffer([]byte{0x12, 0x9C, 0xBE, Srs, 0xC1}))
+	n, err = d.WriteTo(&out)
+	if !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if out.String() != "Мо" || n != 4 {
+		t.Fatalf("Unexpected result: %d, %s", n, out.String())
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, input := range [][]byte{
+		nil,
+		refEncoded,
+		{0x12, 0x9C, 0xBE},
+		{SQU, 0xD8, 0x3D, SQU, 0xDE, 0x00},
+	} {
+		if !Valid(input) {
+			t.Fatalf("%v: expected to be valid", input)
+		}
+	}
+	for _, input := range [][]byte{
+		{0x12, 0x9C, Srs},
+		{SD0},
+		{SCU, 0xD8},
+		{SD0, 0x00},
+		{SQU, 0xDE, 0x00},
+	} {
+		if Valid(input) {
+			t.Fatalf("%v: expected to be invalid", input)
+		}
+	}
+}
+
+func BenchmarkValid(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = Valid(refEncoded)
+	}
+}
+
+func TestDecodedLen(t *testing.T) {
+	n, err := DecodedLen(refEncoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(referenceString) {
+		t.Fatalf("Unexpected len: %d", n)
+	}
+	if _, err = DecodedLen([]byte{0x12, 0x9C, Srs}); !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buf, err := AppendDecode(make([]byte, 0, n), refEncoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cap(buf) != n || string(buf) != referenceString {
+		t.Fatal("Unexpected result")
+	}
+}
+
+func TestDecodeReservedWindowOffset(t *testing.T) {
+	for _, input := range [][]byte{
+		{SD0, reservedStart},
+		{SD3, fixedThreshold - 1},
+		{SCU, UD1, 0xB0},
+	} {
+		_, err := Decode(input)
+		if !errors.Is(err, ErrIllegalInput) {
+			t.Fatalf("%v: unexpected error: %v", input, err)
+		}
+	}
+	_, err := Decode([]byte{SD0, 0xA8})
+	if err.Error() != "illegal input: reserved window offset 0xa8 at offset 2" {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	var input []byte
+	for _, s := range []string{referenceString, "Ελλάδα 😀 \U0010FFFF  a\u0001", "山自作 Москва"} {
+		b, err := Encode(s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input = append(input, b...)
+	}
+	input = append(input, SQU, 0xD8, 0x3D, SQU, 0xDE, 0x00, SCU, UQU, 0xD8, 0x3D, 0xDE, 0x00, UD0, 0x01, SDX, 0x12, 0x34)
+
+	for i := 0; i < len(input); i++ {
+		_, err := Decode(input[:i])
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestBytesReadLarge(t *testing.T) {
+	d := NewReader(bytes.NewBuffer([]byte{0x12, 0x9C, 0xBE}))
+	d.bytesRead = math.MaxInt32
+	r, n, err := d.ReadRune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 'М' || n != 2 {
+		t.Fatalf("Unexpected result: %c, %d", r, n)
+	}
+	if d.BytesRead() != math.MaxInt32+2 {
+		t.Fatalf("Unexpected BytesRead: %d", d.BytesRead())
+	}
+}
+
+func TestDecodeLenientReplacement(t *testing.T) {
+	input := []byte{0x12, 0x9C, 0xBE, Srs, 0xC1}
+	s, err := NewReaderWithOptions(bytes.NewBuffer(input), DecoderOptions{Lenient: true, Replacement: '?'}).ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "Мо?с" {
+		t.Fatal(s)
+	}
+
+	for _, r := range []rune{0xD800, 0xDFFF, utf8.MaxRune + 1, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%#x: expected a panic", r)
+				}
+			}()
+			NewReaderWithOptions(bytes.NewBuffer(input), DecoderOptions{Lenient: true, Replacement: r})
+		}()
+	}
+}
+
+func TestNewReaderString(t *testing.T) {
+	s, err := NewReaderString(string(refEncoded)).ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != referenceString {
+		t.Fatal(s)
+	}
+}
+
+func TestDecodeString(t *testing.T) {
+	s, err := DecodeString(string(refEncoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != referenceString {
+		t.Fatal(s)
+	}
+	if _, err := DecodeString("\x12\x9C\xBE\x0C\xC1"); !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func BenchmarkDecodeString(b *testing.B) {
+	input := string(refEncoded)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = DecodeString(input)
+	}
+}
+
+func BenchmarkDecodeStringConv(b *testing.B) {
+	input := string(refEncoded)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = Decode([]byte(input))
+	}
+}
+
+func BenchmarkReadString(b *testing.B) {
+	var r Reader
+	var src bytes.Reader
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		src.Reset(refEncoded)
+		r.Reset(&src)
+		_, _ = r.ReadString()
+	}
+}
+
+var largeEncoded = bytes.Repeat(refEncoded, 100)
+
+func BenchmarkDecodeLarge(b *testing.B) {
+	b.SetBytes(int64(len(largeEncoded)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = Decode(largeEncoded)
+	}
+}
+
+func BenchmarkDecodeASCII(b *testing.B) {
+	encoded, err := Encode(asciiDoc, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(encoded)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = Decode(encoded)
+	}
+}
+
+func TestDecodeLargeAllocs(t *testing.T) {
+	s := strings.Repeat(asciiDoc, 16)
+	encoded, err := Encode(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	res, err := Decode(encoded)
+	runtime.ReadMemStats(&after)
+	if err != nil || res != s {
+		t.Fatal(err)
+	}
+	// the result is the only large allocation
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(len(s))*5/4 {
+		t.Fatalf("%d bytes allocated for %d bytes of output", allocated, len(s))
+	}
+}
+
+func BenchmarkDecodeBytesASCII(b *testing.B) {
+	encoded, err := Encode(asciiDoc, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(encoded)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = DecodeBytes(encoded)
+	}
+}
+
+func BenchmarkDecodeLargeByteReader(b *testing.B) {
+	b.SetBytes(int64(len(largeEncoded)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = NewReader(bytes.NewReader(largeEncoded)).ReadStringSizeHint(len(largeEncoded))
+	}
+}
+
+func TestReadStringInto(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("<")
+	if err := NewReader(bytes.NewReader(refEncoded)).ReadStringInto(&sb); err != nil {
+		t.Fatal(err)
+	}
+	sb.WriteString("><")
+	if err := NewReader(bytes.NewReader([]byte{0x12, 0x9C, 0xBE, 0xC1, 0xBA, 0xB2, 0xB0})).ReadStringInto(&sb); err != nil {
+		t.Fatal(err)
+	}
+	sb.WriteString(">")
+	if s := sb.String(); s != "<"+referenceString+"><Москва>" {
+		t.Fatal(s)
+	}
+
+	sb.Reset()
+	sb.WriteString("x")
+	err := NewReader(bytes.NewReader([]byte{0x12, 0x9C, Srs})).ReadStringInto(&sb)
+	if !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sb.String() != "x" {
+		t.Fatal(sb.String())
+	}
+}
+
+func TestRejectRedundant(t *testing.T) {
+	s := referenceString + "Москва Ελλάδα 東京 😀 Москва"
+	b, err := Encode(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := NewReaderWithOptions(bytes.NewReader(b), DecoderOptions{RejectRedundant: true}).ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != s {
+		t.Fatal(res)
+	}
+
+	for _, input := range [][]byte{
+		{0x41, SC0, 0x41},                        // window 0 is active initially
+		{SC2, 0x9C, SC2, 0x9C},                   // window 2 is selected twice
+		{SD2, 0x08, 0x9C},                        // window 2 is at U+0400 initially
+		{SDX, 0x80, 0x00, SDX, 0x80, 0x00, 0x80}, // window 4 is defined twice as U+10000
+		{SCU, 0x4E, 0x00, UD2, 0x08, 0x9C},
+	} {
+		if _, err := Decode(input); err != nil {
+			t.Fatalf("% x: %v", input, err)
+		}
+		_, err := NewReaderWithOptions(bytes.NewReader(input), DecoderOptions{RejectRedundant: true}).ReadString()
+		var de *DecodeError
+		if !errors.Is(err, ErrRedundantCommand) || !errors.As(err, &de) {
+			t.Fatalf("% x: unexpected error: %v", input, err)
+		}
+	}
+}
+
+func TestLenientSrs(t *testing.T) {
+	for _, test := range []struct {
+		input  []byte
+		result string
+	}{
+		{[]byte{'a', Srs, 'b'}, "a�b"},
+		{[]byte{'a', Srs}, "a�"},
+		{[]byte{Srs, Srs, 0x12, 0x9C}, "��М"},
+		{[]byte{0x12, Srs, 0x9C}, "�М"}, // the window selection is preserved
+	} {
+		if _, err := Decode(test.input); !errors.Is(err, ErrIllegalInput) {
+			t.Fatalf("% x: unexpected error: %v", test.input, err)
+		}
+		s, err := NewReaderWithOptions(bytes.NewReader(test.input), DecoderOptions{Lenient: true}).ReadString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != test.result {
+			t.Fatalf("% x: %q", test.input, s)
+		}
+	}
+}
+
+func TestReadStringN(t *testing.T) {
+	msg1, _ := Encode("Москва", nil)
+	msg2, _ := Encode("Ελλάδα", nil)
+	input := append(append([]byte{}, msg1...), msg2...)
+	input = append(input, 0xFF, 0xFF)
+
+	br := bytes.NewReader(input)
+	r := NewReader(br)
+	s, err := r.ReadStringN(len(msg1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "Москва" || r.BytesRead() != int64(len(msg1)) || br.Len() != len(input)-len(msg1) {
+		t.Fatal(s, r.BytesRead(), br.Len())
+	}
+
+	// each message is decoded with a fresh state
+	r.Reset(br)
+	s, err = r.ReadStringN(len(msg2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "Ελλάδα" || br.Len() != 2 {
+		t.Fatal(s, br.Len())
+	}
+
+	// the limit splits a window definition
+	r.Reset(bytes.NewReader([]byte{SD0, 0xFB, 0xB1}))
+	if _, err := r.ReadStringN(1); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// the limit is larger than the input
+	r.Reset(bytes.NewReader(msg1))
+	if s, err := r.ReadStringN(100); err != nil || s != "Москва" {
+		t.Fatal(s, err)
+	}
+}
+
+// hides the io.ByteReader implementation
+type plainReader struct {
+	r io.Reader
+}
+
+func (p plainReader) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+var hugeEncoded = bytes.Repeat(refEncoded, 4<<20/len(refEncoded))
+
+func BenchmarkNewReaderFrom(b *testing.B) {
+	b.SetBytes(int64(len(hugeEncoded)))
+	for i := 0; i < b.N; i++ {
+		r := NewReaderFrom(plainReader{bytes.NewReader(hugeEncoded)})
+		_, _ = r.ReadString()
+	}
+}
+
+func BenchmarkNewReaderBufio(b *testing.B) {
+	b.SetBytes(int64(len(hugeEncoded)))
+	for i := 0; i < b.N; i++ {
+		r := NewReader(bufio.NewReader(plainReader{bytes.NewReader(hugeEncoded)}))
+		_, _ = r.ReadString()
+	}
+}
+
+func TestReadStringCount(t *testing.T) {
+	s, n, err := NewReader(bytes.NewReader(refEncoded)).ReadStringCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != referenceString || n != utf8.RuneCountInString(referenceString) {
+		t.Fatal(s, n)
+	}
+
+	// the signature is not counted
+	s, n, err = NewReader(bytes.NewReader([]byte{SQU, 0xFE, 0xFF, 'a', 'b'})).ReadStringCount()
+	if err != nil || s != "ab" || n != 2 {
+		t.Fatal(s, n, err)
+	}
+
+	s, n, err = NewReader(bytes.NewReader([]byte{'a', Srs})).ReadStringCount()
+	if !errors.Is(err, ErrIllegalInput) || s != "" || n != 0 {
+		t.Fatal(s, n, err)
+	}
+}
+
+func TestResetWindows(t *testing.T) {
+	rec1 := []byte{SD2, 0xFB, 0xC1, 0xC2} // window 2 is redefined as Greek
+	rec2 := []byte{SC2, 0x9C, 0xBE}       // relies on the default window 2 (Cyrillic)
+	br := bytes.NewReader(append(append([]byte{}, rec1...), rec2...))
+	r := NewReader(br)
+	s, err := r.ReadStringN(len(rec1))
+	if err != nil || s != "αβ" {
+		t.Fatal(s, err)
+	}
+	r.ResetWindows()
+	if r.WindowState() != NewReader(nil).WindowState() {
+		t.Fatal("window state has not been reset")
+	}
+	s, err = r.ReadString()
+	if err != nil || s != "Мо" {
+		t.Fatal(s, err)
+	}
+	if r.BytesRead() != int64(len(rec1)+len(rec2)) {
+		t.Fatal(r.BytesRead())
+	}
+}
+
+func TestOffsetTables(t *testing.T) {
+	fixed := FixedOffsets()
+	for i, offset := range fixed {
+		r := NewReader(bytes.NewReader([]byte{SD0, byte(FixedThreshold + i), 0x80}))
+		c, _, err := r.ReadRune()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != offset {
+			t.Fatalf("%d: %#x != %#x", i, c, offset)
+		}
+	}
+	// the returned tables are copies
+	fixed[0] = 0
+	if FixedOffsets()[0] != 0xC0 {
+		t.Fatal("the table has been modified")
+	}
+	if InitialDynamicOffsets()[2] != 0x400 || StaticOffsets()[4] != 0x2000 {
+		t.Fatal("unexpected offsets")
+	}
+	r := NewReader(bytes.NewReader([]byte{SD0, GapThreshold, 0x80}))
+	if c, _, err := r.ReadRune(); err != nil || c != GapThreshold<<7+GapOffset {
+		t.Fatal(c, err)
+	}
+	r = NewReader(bytes.NewReader([]byte{SD0, ReservedStart, 0x80}))
+	if _, _, err := r.ReadRune(); !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestDecodeChunk(t *testing.T) {
+	const s = referenceString + "Москва Ελλάδα 東京 😀\U0010FFFD"
+	input, err := Encode(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for size := 1; size < 8; size++ {
+		var r Reader
+		r.Reset(nil)
+		var out []byte
+		rest := input
+		for len(rest) > 0 {
+			n := size
+			if n > len(rest) {
+				n = len(rest)
+			}
+			out, err = r.DecodeChunk(out, rest[:n])
+			if err != nil && err != ErrNeedMore {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		if err != nil {
+			t.Fatalf("%d: %v", size, err)
+		}
+		if string(out) != s {
+			t.Fatalf("%d: %q", size, out)
+		}
+	}
+
+	var r Reader
+	r.Reset(nil)
+	out, err := r.DecodeChunk(nil, []byte{'a', SDX, 0x80})
+	if err != ErrNeedMore || string(out) != "a" {
+		t.Fatal(string(out), err)
+	}
+	out, err = r.DecodeChunk(out, nil)
+	if err != ErrNeedMore || string(out) != "a" {
+		t.Fatal(string(out), err)
+	}
+	out, err = r.DecodeChunk(out, []byte{0x00, 0x80, Srs})
+	if !errors.Is(err, ErrIllegalInput) || string(out) != "a\U00010000" {
+		t.Fatal(string(out), err)
+	}
+}
+
+func TestExtendedWindowRange(t *testing.T) {
+	// the highest possible extended window for each window index
+	for win := byte(0); win < 8; win++ {
+		for _, input := range [][]byte{
+			{SDX, win<<5 | 0x1F, 0xFF, 0xFF},
+			{SCU, UDX, win<<5 | 0x1F, 0xFF, 0xFF},
+		} {
+			s, err := Decode(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s != "\U0010FFFF" {
+				t.Fatalf("% x: %q", input, s)
+			}
+		}
+	}
+}
+
+func TestDecodeTo(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := DecodeTo(&buf, refEncoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(referenceString) || buf.String() != referenceString {
+		t.Fatal(n, buf.String())
+	}
+
+	buf.Reset()
+	n, err = DecodeTo(&buf, []byte{0x12, 0x9C, 0xBE, Srs, 0xC1})
+	if !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n != 4 || buf.String() != "Мо" {
+		t.Fatal(n, buf.String())
+	}
+}
+
+func TestMaxCommands(t *testing.T) {
+	toggles := bytes.Repeat([]byte{SCU, UC0}, 5000)
+	input := append(append([]byte{'a'}, toggles...), 'b')
+	if s, err := Decode(input); err != nil || s != "ab" {
+		t.Fatal(s, err)
+	}
+	r := NewReaderWithOptions(bytes.NewReader(input), DecoderOptions{MaxCommands: 100})
+	if _, err := r.ReadString(); !errors.Is(err, ErrTooManyCommands) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// the limit is not replaced in lenient mode
+	r = NewReaderWithOptions(bytes.NewReader(bytes.Repeat([]byte{SC1, SC2}, 50)), DecoderOptions{MaxCommands: 10, Lenient: true})
+	if s, err := r.ReadString(); !errors.Is(err, ErrTooManyCommands) {
+		t.Fatalf("Unexpected result: %q, %v", s, err)
+	}
+
+	// the counter is reset by every character
+	var interleaved []byte
+	for i := 0; i < 1000; i++ {
+		interleaved = append(interleaved, SC1, SC2, SD3, 0x08, SDX, 0x80, 0x00, 'a') // 4 commands
+	}
+	r = NewReaderWithOptions(bytes.NewReader(interleaved), DecoderOptions{MaxCommands: 4})
+	if s, err := r.ReadString(); err != nil || s != strings.Repeat("a", 1000) {
+		t.Fatal(err)
+	}
+	r = NewReaderWithOptions(bytes.NewReader(interleaved), DecoderOptions{MaxCommands: 3})
+	if _, err := r.ReadString(); !errors.Is(err, ErrTooManyCommands) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// an incomplete command at the end of a chunk is not counted twice
+	for _, input := range [][]byte{{SC1, SD0, 0x08, 0x41}, interleaved} {
+		r = NewReaderWithOptions(bytes.NewReader(nil), DecoderOptions{MaxCommands: 4, MaxRunes: 1000})
+		var out []byte
+		var err error
+		for i := range input {
+			out, err = r.DecodeChunk(out, input[i:i+1])
+			if err != nil && err != ErrNeedMore {
+				t.Fatalf("%d: %v", i, err)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, _ := Decode(input); string(out) != expected {
+			t.Fatalf("%q", out)
+		}
+	}
+}
+
+func TestLooksLikeSCSU(t *testing.T) {
+	windows, _ := Encode("Москва Ελλάδα", nil)
+	sig, _ := NewEncoderWithOptions(EncoderOptions{Signature: true}).Encode(StringRuneSource("abc"), nil)
+	for _, test := range []struct {
+		input []byte
+		scsu  bool
+	}{
+		{refEncoded, true},
+		{windows, true},
+		{sig, true},
+		{[]byte{0xD0, 0xB1, 0xE4}, true}, // not a valid UTF-8
+		{nil, false},
+		{[]byte("plain ASCII text\r\n"), false},
+		{[]byte("Москва"), false},
+		{[]byte(referenceString), false},
+		{[]byte{0x41, Srs}, false}, // not a valid SCSU
+	} {
+		if res := LooksLikeSCSU(test.input); res != test.scsu {
+			t.Fatalf("% x: %v", test.input, res)
+		}
+	}
+}
+
+func TestActiveWindow(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte{'a', SC2, 0x9C, SD3, 0xFB, 0xC1, SDX, 0xA0, 0x01, 0x80}))
+	for _, expected := range []Window{{0, 0x80}, {2, 0x400}, {3, 0x370}, {5, 0x10080}} {
+		if _, _, err := r.ReadRune(); err != nil {
+			t.Fatal(err)
+		}
+		if w := r.ActiveWindow(); w.Index() != expected.index || w.Offset() != expected.offset {
+			t.Fatalf("%d, %#x", w.Index(), w.Offset())
+		}
+	}
+}
+
+func TestTruncatedBranches(t *testing.T) {
+	for _, input := range [][]byte{
+		{SQ1, 0x41},                        // SQn
+		{SDX, 0x80, 0x00},                  // SDX
+		{SD1, 0x08},                        // SDn
+		{SQU, 0x4E, 0x00},                  // SQU
+		{SQU, 0xD8, 0x3D, SQU, 0xDE, 0x00}, // SQU surrogate pair
+		{SCU, 0x4E, 0x00},                  // Unicode mode character
+		{SCU, 0xD8, 0x3D, 0xDE, 0x00},      // Unicode mode surrogate pair
+		{SCU, UQU, 0xE0, 0x00},             // UQU
+		{SCU, UQU, 0xD8, 0x3D, 0xDE, 0x00}, // UQU surrogate pair
+		{SCU, UD1, 0x08},                   // UDn
+		{SCU, UDX, 0x80, 0x00},             // UDX
+	} {
+		if _, err := Decode(input); err != nil {
+			t.Fatalf("% x: %v", input, err)
+		}
+		start := 1
+		if input[0] == SCU {
+			start = 2 // SCU alone is a complete command
+		}
+		for i := start; i < len(input); i++ {
+			if _, err := Decode(input[:i]); err != io.ErrUnexpectedEOF {
+				t.Fatalf("% x: unexpected error: %v", input[:i], err)
+			}
+		}
+	}
+}
+
+func TestRecordDecoder(t *testing.T) {
+	// Ԋ is encoded as SD3 0A 8A, the delimiter is a command argument; 東京 ends in Unicode mode
+	records := []string{"Москва", "", "Ελλάδα", "Ԋ", "plain", "東京", "Ünïcödé"}
+	var buf bytes.Buffer
+	for i, s := range records {
+		b, err := EncodeStrict(s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(b)
+		if i < len(records)-1 {
+			buf.WriteByte('\n') // no delimiter after the last record
+		}
+	}
+	buf.Write([]byte{'\n', 0x41, Srs, '\n', 'o', 'k', '\n'})
+	records = append(records, "", "ok")
+	failed := len(records) - 2
+	// the delimiter right after a command
+	buf.Write([]byte{SC1, '\n', 'a', '\n', SD2, 0x10, '\n', 'b'})
+	records = append(records, "", "a", "", "b")
+	d := NewRecordDecoder(iotest.OneByteReader(&buf), '\n')
+	for i, expected := range records {
+		s, err := d.Next()
+		if i == failed {
+			if !errors.Is(err, ErrIllegalInput) {
+				t.Fatalf("%d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if s != expected {
+			t.Fatalf("%d: %q != %q", i, s, expected)
+		}
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRecordDecoderLong(t *testing.T) {
+	long := strings.Repeat("Привет, мир! ", 1000)
+	b, err := EncodeStrict(long, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewRecordDecoder(bytes.NewReader(append(b, '\n')), '\n')
+	if s, err := d.Next(); err != nil || s != long {
+		t.Fatalf("%v", err)
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTreatReservedAsLatin1(t *testing.T) {
+	input, err := Encode("Страница 1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input = append(input, Srs) // a raw form feed
+	tail, err := Encode("Страница 2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input = append(input, tail...)
+	if _, err := Decode(input); !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s, err := NewReaderWithOptions(bytes.NewReader(input), DecoderOptions{TreatReservedAsLatin1: true}).ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Страница 1\fСтраница 2"; s != expected {
+		t.Fatalf("%q != %q", s, expected)
+	}
+}
+
+func TestDecodeErrorRune(t *testing.T) {
+	for _, test := range []struct {
+		input []byte
+		opts  DecoderOptions
+		rune  int
+	}{
+		{[]byte{
+			0x12, 0x9C, 0xBE, // Мо
+			SD1, 0x0C, // a window definition doesn't produce a character
+			SQU, 0x4E, 0x00, // 一
+			SCU, 0x00, 0x41, 0xD8, 0x3D, 0x00, 0x41, // A followed by a broken surrogate pair
+		}, DecoderOptions{}, 4},
+		// replacement characters are counted
+		{[]byte{'a', Srs, SC0}, DecoderOptions{Lenient: true, RejectRedundant: true}, 2},
+	} {
+		_, err := NewReaderWithOptions(bytes.NewReader(test.input), test.opts).ReadString()
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Fatalf("% x: unexpected error: %v", test.input, err)
+		}
+		if decodeErr.Rune != test.rune {
+			t.Fatalf("% x: unexpected rune index: %d", test.input, decodeErr.Rune)
+		}
+	}
+}
+
+func TestUnicodeModeSurrogateOrder(t *testing.T) {
+	for _, input := range [][]byte{
+		{SCU, 0xDE, 0x00, 0xD8, 0x3D}, // low surrogate first
+		{SCU, 0xD8, 0x3D, 0xD8, 0x3D}, // two high surrogates
+		{SCU, 0xDE, 0x00, 0xDE, 0x00}, // two low surrogates
+		{SCU, 0xD8, 0x3D, 0x00, 0x41}, // a high surrogate followed by a non-surrogate
+	} {
+		if _, err := Decode(input); !errors.Is(err, ErrIllegalInput) {
+			t.Fatalf("% x: unexpected error: %v", input, err)
+		}
+	}
+	s, err := Decode([]byte{SCU, 0xD8, 0x3D, 0xDE, 0x00})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "\U0001F600" {
+		t.Fatalf("%q", s)
+	}
+}
+
+// repeatReader returns b over and over again, it never ends
+type repeatReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.b[r.pos:])
+		n += c
+		r.pos = (r.pos + c) % len(r.b)
+	}
+	return n, nil
+}
+
+func TestMaxInputBytes(t *testing.T) {
+	msg, err := Encode("Москва ", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReaderWithOptions(bufio.NewReader(&repeatReader{b: msg}), DecoderOptions{MaxInputBytes: 10000})
+	_, err = r.ReadString()
+	if !errors.Is(err, ErrInputTooLarge) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.BytesRead() != 10000 {
+		t.Fatal(r.BytesRead())
+	}
+
+	// commands alone must not bypass the limit
+	r = NewReaderWithOptions(bufio.NewReader(&repeatReader{b: []byte{SC1, SC2}}), DecoderOptions{MaxInputBytes: 100})
+	if _, _, err := r.ReadRune(); !errors.Is(err, ErrInputTooLarge) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the limit itself is allowed
+	r = NewReaderWithOptions(bytes.NewReader(msg), DecoderOptions{MaxInputBytes: int64(len(msg))})
+	if s, err := r.ReadString(); err != nil || s != "Москва " {
+		t.Fatalf("%q, %v", s, err)
+	}
+}
+
+func TestOnCommand(t *testing.T) {
+	input := []byte{
+		'a',
+		SC2, 0x9C,
+		SQ0, 0x01,
+		SD3, 0xFB, 0xC1,
+		SQU, 0x4E, 0x00,
+		SCU, 0x4E, 0x00,
+		UQU, 0xE0, 0x00,
+		UC1, 0x80,
+	}
+	var commands []CommandInfo
+	r := NewReader(bytes.NewReader(input))
+	r.OnCommand(func(info CommandInfo) {
+		commands = append(commands, info)
+	})
+	s, err := r.ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, _ := Decode(input); s != expected {
+		t.Fatalf("%q != %q", s, expected)
+	}
+	expected := []CommandInfo{
+		{Offset: 1, Tag: SC2, Window: 2, WindowOffset: 0x400, Char: -1},
+		{Offset: 3, Tag: SQ0, Window: 0, WindowOffset: 0, Char: 0x01},
+		{Offset: 5, Tag: SD3, Window: 3, WindowOffset: 0x370, Char: -1},
+		{Offset: 8, Tag: SQU, Window: -1, Char: 0x4E00},
+		{Offset: 11, Tag: SCU, Window: -1, Char: -1},
+		{Offset: 14, Tag: UQU, Window: -1, Char: 0xE000},
+		{Offset: 17, Tag: UC1, Window: 1, WindowOffset: 0xC0, Char: -1},
+	}
+	if len(commands) != len(expected) {
+		t.Fatalf("%+v", commands)
+	}
+	for i, info := range commands {
+		if info != expected[i] {
+			t.Fatalf("%d: %+v != %+v", i, info, expected[i])
+		}
+	}
+}
+
+func TestDecodeASCIIFastPath(t *testing.T) {
+	mixed, err := Encode("plain text, Москва\r\n\tand more text 一二三 then text again\x00", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range [][]byte{
+		mixed,
+		refEncoded,
+		append(signature[:len(signature):len(signature)], "ASCII after the signature"...),
+		{SCU, 0x00, 0x41, 0x00, 0x42}, // ASCII in Unicode mode
+		[]byte("text with a tag\x0b"),
+	} {
+		for _, opts := range []DecoderOptions{{}, {MaxRunes: 20}, {MaxInputBytes: 20}} {
+			// iotest.OneByteReader hides the underlying *bytes.Reader, so the general path is used
+			expected, expectedErr := NewReaderWithOptions(bufio.NewReader(iotest.OneByteReader(bytes.NewReader(input))), opts).ReadString()
+			s, err := NewReaderWithOptions(&sliceByteReader{b: input}, opts).ReadString()
+			if s != expected || !errors.Is(err, expectedErr) && err != expectedErr {
+				t.Fatalf("% x, %+v: %q, %v != %q, %v", input, opts, s, err, expected, expectedErr)
+			}
+			if opts == (DecoderOptions{}) {
+				b, err := DecodeBytes(input)
+				if string(b) != expected || !errors.Is(err, expectedErr) && err != expectedErr {
+					t.Fatalf("% x: DecodeBytes: %q, %v", input, b, err)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeEmpty(t *testing.T) {
+	for _, input := range [][]byte{nil, {}} {
+		s, err := Decode(input)
+		if s != "" || err != nil {
+			t.Fatalf("%v: %q, %v", input, s, err)
+		}
+		if b, err := DecodeBytes(input); len(b) != 0 || err != nil {
+			t.Fatalf("%v: % x, %v", input, b, err)
+		}
+		if runes, err := DecodeRunes(input); len(runes) != 0 || err != nil {
+			t.Fatalf("%v: %v, %v", input, runes, err)
+		}
+		if n, err := DecodedLen(input); n != 0 || err != nil {
+			t.Fatalf("%v: %d, %v", input, n, err)
+		}
+		if !Valid(input) {
+			t.Fatalf("%v: not valid", input)
+		}
+	}
+	r := NewReader(bytes.NewReader(nil))
+	if _, _, err := r.ReadRune(); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatalf("%d, %v", n, err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	for _, r := range []*Reader{
+		NewReader(bytes.NewReader(refEncoded)),
+		NewReaderString(string(refEncoded)),
+		NewReaderWithOptions(&sliceByteReader{b: refEncoded}, DecoderOptions{}),
+	} {
+		var head strings.Builder
+		for i := 0; i < 20; i++ {
+			c, _, err := r.ReadRune()
+			if err != nil {
+				t.Fatal(err)
+			}
+			head.WriteRune(c)
+		}
+		c := r.Clone()
+		if c.WindowState() != r.WindowState() || c.BytesRead() != r.BytesRead() {
+			t.Fatal("state differs")
+		}
+		tail1, err := r.ReadString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tail2, err := c.ReadString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tail1 != tail2 || head.String()+tail1 != referenceString {
+			t.Fatalf("%q != %q", tail1, tail2)
+		}
+	}
+
+	// the underlying reader is shared
+	r := NewReader(bufio.NewReader(bytes.NewReader([]byte("abc"))))
+	r.ReadRune()
+	c := r.Clone()
+	r.ReadRune()
+	if ch, _, err := c.ReadRune(); err != nil || ch != 'c' {
+		t.Fatalf("%q, %v", ch, err)
+	}
+}
+
+func TestUnreadRune(t *testing.T) {
+	var _ io.RuneScanner = (*Reader)(nil)
+	r := NewReader(bytes.NewReader(refEncoded))
+	if err := r.UnreadRune(); err != ErrInvalidUnreadRune {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var head []rune
+	for i := 0; i < 10; i++ {
+		state, bytesRead := r.WindowState(), r.BytesRead()
+		c, size, err := r.ReadRune()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.UnreadRune(); err != nil {
+			t.Fatal(err)
+		}
+		if r.WindowState() != state || r.BytesRead() != bytesRead {
+			t.Fatalf("%d: the state was not restored", i)
+		}
+		if err := r.UnreadRune(); err != ErrInvalidUnreadRune {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		c1, size1, err := r.ReadRune()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c1 != c || size1 != size {
+			t.Fatalf("%d: %q, %d != %q, %d", i, c1, size1, c, size)
+		}
+		head = append(head, c)
+	}
+	if err := r.UnreadRune(); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := r.ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(head[:len(head)-1])+tail != referenceString {
+		t.Fatal(tail)
+	}
+	if err := r.UnreadRune(); err != ErrInvalidUnreadRune {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the ASCII fast path must not overtake the unread character
+	b, err := Encode("xМabc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewReaderFrom(plainReader{bytes.NewReader(b)})
+	r.ReadRune()
+	r.ReadRune()
+	r.UnreadRune()
+	if s, err := r.ReadString(); err != nil || s != "Мabc" {
+		t.Fatalf("%q, %v", s, err)
+	}
+}
+
+func TestSplitStreams(t *testing.T) {
+	docs := []string{"Москва", "Ελλάδα", referenceString, "東京一二三"}
+	var all []byte
+	for _, doc := range docs {
+		b, err := NewEncoderWithOptions(EncoderOptions{Signature: true}).Encode(StringRuneSource(doc), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, b...)
+	}
+	streams, err := SplitStreams(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != len(docs) {
+		t.Fatalf("%d streams", len(streams))
+	}
+	for i, stream := range streams {
+		s, err := Decode(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != docs[i] {
+			t.Fatalf("%d: %q != %q", i, s, docs[i])
+		}
+	}
+
+	if streams, err := SplitStreams(nil); err != nil || len(streams) != 0 {
+		t.Fatalf("%v, %v", streams, err)
+	}
+	if streams, err := SplitStreams([]byte("abc")); err != nil || len(streams) != 1 {
+		t.Fatalf("%v, %v", streams, err)
+	}
+
+	// the last document ends in Unicode mode
+	_, err = SplitStreams(append(all, UC0, SQU, 0xFE, 0xFF, 'a', Srs))
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Offset != int64(len(all)+6) || decodeErr.Rune != 1 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the signature bytes in a Unicode mode run are not a stream boundary (U+410E, U+FEFF, ...), this must not
+	// take quadratic time
+	large := append([]byte{SCU, 0x41}, bytes.Repeat([]byte{SQU, 0xFE, 0xFF, 0x41}, 100000)...)
+	large = append(large, SQU)
+	if streams, err := SplitStreams(large); err != nil || len(streams) != 1 {
+		t.Fatalf("%d, %v", len(streams), err)
+	}
+	large = append(large, UC0)
+	streams, err = SplitStreams(append(large, all...))
+	if err != nil || len(streams) != len(docs)+1 || len(streams[0]) != len(large) {
+		t.Fatalf("%d, %v", len(streams), err)
+	}
+
+	// in Unicode mode the signature bytes are a part of a character (U+0EFE, U+FF21)
+	misaligned := []byte{SCU, SQU, 0xFE, 0xFF, 0x21}
+	if streams, err := SplitStreams(misaligned); err != nil || len(streams) != 1 {
+		t.Fatalf("%d, %v", len(streams), err)
+	}
+	if s, err := Decode(misaligned); err != nil || s != "\u0efe\uff21" {
+		t.Fatalf("%q, %v", s, err)
+	}
+}
+
+func TestSignatureBytes(t *testing.T) {
+	sig := SignatureBytes()
+	if !bytes.Equal(sig, []byte{0x0E, 0xFE, 0xFF}) {
+		t.Fatalf("% x", sig)
+	}
+	sig[0] = 0
+	if SignatureBytes()[0] != SQU {
+		t.Fatal("SignatureBytes does not return a copy")
+	}
+
+	b, err := NewEncoderWithOptions(EncoderOptions{Signature: true}).Encode(StringRuneSource("abc"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, SignatureBytes()) {
+		t.Fatalf("% x", b)
+	}
+	if s, err := Decode(b); err != nil || s != "abc" {
+		t.Fatalf("%q, %v", s, err)
+	}
+}
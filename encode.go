@@ -1,6 +1,7 @@
 package scsu
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -20,19 +21,47 @@ type RuneSource interface {
 	RuneAt(pos int) (r rune, nextPos int, err error)
 }
 
-// StrictStringRuneSource does not tolerate invalid UTF-8 sequences.
+// StrictStringRuneSource does not tolerate invalid UTF-8 sequences, an *InvalidUTF8Error
+// is returned instead.
 type StrictStringRuneSource string
 
 // StringRuneSource represents an UTF-8 string. Invalid sequences are replaced with
 // utf8.RuneError.
 type StringRuneSource string
 
+// BytesRuneSource represents UTF-8 in a byte slice. The runes are decoded in place, so there
+// is no need to convert the slice into a string. Like StrictStringRuneSource it
+// does not tolerate invalid UTF-8 sequences.
+type BytesRuneSource []byte
+
 // SingleRuneSource that contains a single rune.
 type SingleRuneSource rune
 
 // RuneSlice is a RuneSource backed by []rune.
 type RuneSlice []rune
 
+// UTF16RuneSource is a RuneSource backed by UTF-16 code units. Positions are indexes into the slice.
+// Unpaired surrogates result in ErrInvalidUTF16.
+type UTF16RuneSource []uint16
+
+// streamRuneSource is a RuneSource over a sequential source of runes. Positions are the rune indexes.
+// Runes which may be requested again are buffered, the encoder calls release() when it moves forward.
+type streamRuneSource struct {
+	next func() (rune, error)
+	stop func() // optional, called when the encoder is done with the source
+	buf  []rune
+	base int // position of buf[0]
+	err  error
+}
+
+// implemented by RuneSources that need to know which positions won't be requested anymore
+type runeReleaser interface {
+	// release is called when runes before pos will not be requested anymore
+	release(pos int)
+	// done is called when the encoder has finished with the source
+	done()
+}
+
 type encoder struct {
 	scsu
 	wr      io.Writer // nil when encoding into a slice
@@ -40,33 +69,166 @@ type encoder struct {
 	written int
 
 	src     RuneSource
+	rel     runeReleaser
 	curRune rune
 	curErr  error
 	nextPos int
 	scuPos  int
 
 	nextWindow int
+
+	opts         EncoderOptions
+	stats        EncoderStats
+	bytesWritten int64 // the total number of bytes produced since init()
+
+	started bool // whether anything has been encoded since init()
+}
+
+// EncoderOptions control the behaviour of the encoder.
+type EncoderOptions struct {
+	// UnicodeModeThreshold is the minimum number of consecutive characters that can be encoded using
+	// a window for which the encoder leaves Unicode mode once it has switched to it (e.g. for CJK ideographs).
+	// Shorter runs of such characters (such as punctuation or digits in CJK text) stay in Unicode mode.
+	// Values less than 2 mean the default (2), higher values make the encoder stick to Unicode mode,
+	// which avoids switching back and forth (and defining windows) in predominantly CJK texts.
+	// Values greater than the look-ahead limit (4096) are treated as 4096.
+	UnicodeModeThreshold int
+
+	// OptimizeWindows makes the encoder look ahead when a dynamic window needs to be redefined and
+	// choose the one which is not going to be needed for the longest time rather than the least
+	// recently defined one. This produces more compact output for texts that use more scripts than
+	// there are windows at the cost of extra look-ahead (up to optimizeLookahead characters).
+	OptimizeWindows bool
+
+	// Signature makes the encoder emit the SCSU signature (U+FEFF quoted with SQU, see SignatureBytes)
+	// at the start of the output. Regardless of this option, a U+FEFF at the start of the text is never
+	// encoded as the signature, so it is not dropped by the decoder.
+	Signature bool
+
+	// InitialWindows, if not nil, overrides the initial offsets of the dynamic windows. The decoder
+	// must be configured with the same offsets (see DecoderOptions.InitialWindows). Each offset must be
+	// between 0 and 0x10FF80.
+	InitialWindows *[8]int32
+
+	// InitialActiveWindow is the index (0-7) of the dynamic window that is active at the start. The decoder
+	// must be configured with the same value (see DecoderOptions.InitialActiveWindow).
+	InitialActiveWindow int
+
+	// InitialUnicodeMode makes the encoder start in Unicode mode (as if the output was preceded by SCU),
+	// which saves a byte for texts that start with characters that cannot be encoded using a window,
+	// such as CJK. The decoder must be configured accordingly (see DecoderOptions.InitialUnicodeMode).
+	// If Signature is also set, the signature is written as U+FEFF in Unicode mode (FE FF).
+	InitialUnicodeMode bool
+
+	// DisableUnicodeMode prevents the encoder from switching to Unicode mode. Characters that cannot be
+	// encoded using a window are quoted with SQU instead. The output can be read by a decoder that only
+	// supports single-byte mode at the cost of compression for texts such as CJK. It cannot be combined
+	// with InitialUnicodeMode.
+	DisableUnicodeMode bool
+
+	// PreferUnicodeMode makes the encoder switch to Unicode mode rather than define a new dynamic window
+	// for a BMP character (unless the character that follows fits the same window), and stay in Unicode mode
+	// until there is a run of characters that fit the windows that are already defined. This avoids window
+	// definition churn for texts that are mixing many scripts, including the ones where such characters are
+	// interleaved with emoji. Characters outside of the BMP still get a window when the encoder is in
+	// single-byte mode, because in Unicode mode they take as many bytes as a window definition.
+	PreferUnicodeMode bool
+
+	// QuoteIsolated makes the encoder quote a character that does not fit any of the windows with SQU rather
+	// than define a new window for it, if none of the following characters (within the look-ahead) would use
+	// that window and the next non-ASCII character fits the current one. This saves the command that would be
+	// needed to switch back and keeps the windows that may be needed later, producing smaller output
+	// for short strings such as database column values.
+	QuoteIsolated bool
+}
+
+// EncoderStats contains the statistics collected by the encoder.
+type EncoderStats struct {
+	WindowDefinitions int // number of dynamic window (re-)definitions
+	SingleByteRunes   int // number of runes encoded in single-byte mode (including the quoted ones)
+	UnicodeRunes      int // number of runes encoded in Unicode mode
+	UnicodeSwitches   int // number of switches to Unicode mode
+
+	DynamicWindowRunes [8]int // number of runes encoded using each of the dynamic windows (including the quoted ones)
+	StaticWindowRunes  [8]int // number of runes quoted from each of the static windows (ASCII that is passed through is not included)
+}
+
+// UTF8Writer is an io.WriteCloser that accepts UTF-8, encodes it and writes the result
+// into the underlying writer. UTF-8 sequences can be split between the calls to Write;
+// an incomplete sequence at the end of p is retained until the next Write or Close.
+type UTF8Writer struct {
+	w       Writer
+	tail    [utf8.UTFMax]byte
+	tailLen int
 }
 
 // Encoder can be used to encode a string into []byte.
-// Zero value is ready to use.
+// Zero value is ready to use. An Encoder is not safe for concurrent use, but it can be re-used
+// for subsequent Encode calls.
+//
+// The output is deterministic: it only depends on the input and the options, so the same input
+// always produces the same bytes. Note, this is not a promise that future versions of the package
+// produce the same output, as the encoder may be improved.
 type Encoder struct {
 	encoder
 }
 
+// Writer encodes runes and strings and writes the result into the underlying io.Writer.
+// The encoder state (i.e. the windows and the mode) is preserved between the calls, so that
+// multiple calls produce a single continuous SCSU stream. Like the Reader, it is not safe for concurrent use.
+//
+// The output is written as soon as it's produced: apart from a run of ASCII characters (written in
+// chunks of up to 4096 bytes) the Writer holds back at most a few bytes of output. The encoder looks ahead
+// by at most 4096 characters, so memory usage is bounded when encoding from a stream source such as
+// ReaderRuneSource.
+//
+// The bytes are written strictly in order and only once: a decision that may change the output (such as
+// replacing SCU with SQU for a single character) is made before the affected bytes are written, and the Writer
+// never goes back to modify them. Therefore the underlying writer can be a hash.Hash or any other sink
+// that cannot rewind.
 type Writer struct {
 	encoder
 }
 
 var (
-	ErrInvalidUTF8 = errors.New("invalid UTF-8")
+	ErrInvalidUTF8  = errors.New("invalid UTF-8")
+	ErrInvalidUTF16 = errors.New("invalid UTF-16")
+
+	// ErrInvalidRune is returned when a RuneSource returns a rune that is not a valid Unicode scalar value,
+	// i.e. a surrogate code point or a value outside of the Unicode range.
+	ErrInvalidRune = errors.New("invalid rune")
 )
 
+// InvalidUTF8Error is returned by StrictStringRuneSource and BytesRuneSource (and therefore by EncodeStrict)
+// if the input contains an invalid UTF-8 sequence. It wraps ErrInvalidUTF8.
+type InvalidUTF8Error struct {
+	Offset int // the byte offset of the invalid sequence in the source
+}
+
+func (e *InvalidUTF8Error) Error() string {
+	return fmt.Sprintf("%v at offset %d", ErrInvalidUTF8, e.Offset)
+}
+
+func (e *InvalidUTF8Error) Unwrap() error {
+	return ErrInvalidUTF8
+}
+
 func (s StrictStringRuneSource) RuneAt(pos int) (rune, int, error) {
 	if pos < len(s) {
 		r, size := utf8.DecodeRuneInString(string(s)[pos:])
 		if r == utf8.RuneError && size == 1 {
-			return 0, 0, ErrInvalidUTF8
+			return 0, 0, &InvalidUTF8Error{Offset: pos}
+		}
+		return r, pos + size, nil
+	}
+	return 0, 0, io.EOF
+}
+
+func (s BytesRuneSource) RuneAt(pos int) (rune, int, error) {
+	if pos < len(s) {
+		r, size := utf8.DecodeRune(s[pos:])
+		if r == utf8.RuneError && size == 1 {
+			return 0, 0, &InvalidUTF8Error{Offset: pos}
 		}
 		return r, pos + size, nil
 	}
@@ -88,6 +250,22 @@ func (s RuneSlice) RuneAt(pos int) (rune, int, error) {
 	return 0, 0, io.EOF
 }
 
+func (s UTF16RuneSource) RuneAt(pos int) (rune, int, error) {
+	if pos < len(s) {
+		r := rune(s[pos])
+		if utf16.IsSurrogate(r) {
+			if r < 0xDC00 && pos+1 < len(s) {
+				if r1 := utf16.DecodeRune(r, rune(s[pos+1])); r1 != utf8.RuneError {
+					return r1, pos + 2, nil
+				}
+			}
+			return 0, 0, fmt.Errorf("%w: unpaired surrogate %#x at %d", ErrInvalidUTF16, r, pos)
+		}
+		return r, pos + 1, nil
+	}
+	return 0, 0, io.EOF
+}
+
 func (r SingleRuneSource) RuneAt(pos int) (rune, int, error) {
 	if pos == 0 {
 		return rune(r), 1, nil
@@ -95,6 +273,80 @@ func (r SingleRuneSource) RuneAt(pos int) (rune, int, error) {
 	return 0, 0, io.EOF
 }
 
+func (s *streamRuneSource) RuneAt(pos int) (rune, int, error) {
+	if pos < s.base {
+		// the source is reused by another call to WriteRunes which starts at 0, continue from where
+		// the previous one has stopped
+		pos = s.base
+	}
+	for pos-s.base >= len(s.buf) {
+		if s.err != nil {
+			return 0, 0, s.err
+		}
+		r, err := s.next()
+		if err != nil {
+			s.err = err
+			return 0, 0, err
+		}
+		s.buf = append(s.buf, r)
+	}
+	return s.buf[pos-s.base], pos + 1, nil
+}
+
+func (s *streamRuneSource) release(pos int) {
+	if n := pos - s.base; n > 0 {
+		s.buf = s.buf[:copy(s.buf, s.buf[n:])]
+		s.base = pos
+	}
+}
+
+func (s *streamRuneSource) done() {
+	if s.stop != nil {
+		s.stop()
+	}
+}
+
+// ReaderRuneSource returns a RuneSource that reads runes from r. Only the runes that may be needed for
+// look-ahead are buffered, so it can be used to stream arbitrarily large input.
+// utf8.RuneError returned by r is passed through as is.
+func ReaderRuneSource(r io.RuneReader) RuneSource {
+	return &streamRuneSource{
+		next: func() (rune, error) {
+			c, _, err := r.ReadRune()
+			return c, err
+		},
+	}
+}
+
+// StrictReaderRuneSource is like ReaderRuneSource, however it returns ErrInvalidUTF8 if r
+// encounters an invalid UTF-8 sequence (i.e. returns utf8.RuneError with size 1).
+func StrictReaderRuneSource(r io.RuneReader) RuneSource {
+	return &streamRuneSource{
+		next: func() (rune, error) {
+			c, size, err := r.ReadRune()
+			if err == nil && c == utf8.RuneError && size == 1 {
+				err = ErrInvalidUTF8
+			}
+			return c, err
+		},
+	}
+}
+
+// ChanRuneSource returns a RuneSource that receives runes from ch, blocking until a rune is available.
+// Closing the channel signals the end of input. Only the runes that may be needed for look-ahead
+// are buffered. If the encoding fails, the remaining runes are not received, so the sender must not
+// rely on the channel being drained.
+func ChanRuneSource(ch <-chan rune) RuneSource {
+	return &streamRuneSource{
+		next: func() (rune, error) {
+			if c, ok := <-ch; ok {
+				return c, nil
+			}
+			return 0, io.EOF
+		},
+	}
+}
+
 func NewWriter(wr io.Writer) *Writer {
 	e := new(Writer)
 	e.wr = wr
@@ -102,14 +354,62 @@ func NewWriter(wr io.Writer) *Writer {
 	return e
 }
 
+// NewWriterWithOptions is like NewWriter but allows to specify the encoding options.
+// It panics if any of opts.InitialWindows or opts.InitialActiveWindow is out of range or if both
+// opts.InitialUnicodeMode and opts.DisableUnicodeMode are set.
+func NewWriterWithOptions(wr io.Writer, opts EncoderOptions) *Writer {
+	checkEncoderOptions(&opts)
+	e := NewWriter(wr)
+	e.opts = opts
+	e.init()
+	return e
+}
+
+// NewEncoderWithOptions returns an Encoder that uses the given options.
+// It panics if any of opts.InitialWindows or opts.InitialActiveWindow is out of range or if both
+// opts.InitialUnicodeMode and opts.DisableUnicodeMode are set.
+func NewEncoderWithOptions(opts EncoderOptions) *Encoder {
+	checkEncoderOptions(&opts)
+	e := new(Encoder)
+	e.opts = opts
+	return e
+}
+
+func checkEncoderOptions(opts *EncoderOptions) {
+	checkInitialWindows(opts.InitialWindows, opts.InitialActiveWindow)
+	if opts.InitialUnicodeMode && opts.DisableUnicodeMode {
+		panic(errors.New("scsu: InitialUnicodeMode and DisableUnicodeMode cannot be used together"))
+	}
+}
+
 func (e *encoder) init() {
 	e.scsu.init()
+	if e.opts.InitialWindows != nil {
+		e.dynamicOffset = *e.opts.InitialWindows
+	}
+	e.window = e.opts.InitialActiveWindow
+	e.unicodeMode = e.opts.InitialUnicodeMode
 	e.nextWindow = 3
 	e.scuPos = -1
+	e.stats = EncoderStats{}
+	e.bytesWritten = 0
+	e.started = false
+}
+
+// runeAt is like e.src.RuneAt but makes sure the rune is a valid Unicode scalar value.
+func (e *encoder) runeAt(pos int) (rune, int, error) {
+	r, next, err := e.src.RuneAt(pos)
+	if err == nil && !utf8.ValidRune(r) {
+		return 0, 0, fmt.Errorf("%w: %#x", ErrInvalidRune, r)
+	}
+	return r, next, err
 }
 
 func (e *encoder) nextRune() {
-	e.curRune, e.nextPos, e.curErr = e.src.RuneAt(e.nextPos)
+	e.curRune, e.nextPos, e.curErr = e.runeAt(e.nextPos)
+	if e.rel != nil {
+		e.rel.release(e.nextPos)
+	}
 }
 
 /** locate a window for a character given a table of offsets
@@ -137,6 +437,40 @@ func (e *encoder) locateWindow(ch rune, offsetTable []int32) bool {
 	return false
 }
 
+// whether the character can be encoded in single byte mode without defining a window
+func (e *encoder) fitsWindow(ch rune) bool {
+	if ch < 0x80 {
+		return true
+	}
+	for _, offset := range e.dynamicOffset {
+		if ch >= offset && ch < offset+0x80 {
+			return true
+		}
+	}
+	for _, offset := range staticOffset {
+		if ch >= offset && ch < offset+0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the character should be encoded using a window rather than in Unicode mode. In PreferUnicodeMode
+// this is only the case if it fits one of the existing windows or if it's outside of the BMP (such characters
+// take 4 bytes in Unicode mode, the same as defining a window (SDX) and using it).
+func (e *encoder) preferWindow(ch rune) bool {
+	return !e.opts.PreferUnicodeMode || ch >= 0x10000 || e.fitsWindow(ch)
+}
+
+// whether next fits the window that would be defined for ch, i.e. defining it pays off
+func shareWindow(ch, next rune) bool {
+	if b, ok := WindowIndexFor(ch); ok {
+		offset := windowOffset(b)
+		return next >= offset && next < offset+0x80
+	}
+	return false
+}
+
 /** returns true if the character is ASCII, but not a control other than CR, LF and TAB */
 func isAsciiCrLfOrTab(ch rune) bool {
 	return (ch >= 0x20 && ch <= 0x7F) || // ASCII
@@ -155,20 +489,27 @@ func (e *encoder) outputSingleByteRun() error {
 		ch := e.curRune
 		// ASCII Letter, NUL, CR, LF and TAB are always passed through
 		if isAsciiCrLfOrTab(ch) || ch == 0 {
-			// pass through directly
-			e.out = append(e.out, byte(ch&0x7F))
+			e.outputAsciiRun()
+			err := e.flush()
+			if err != nil {
+				return err
+			}
+			continue
 		} else if ch < 0x20 {
 			// All other control codes must be quoted
 			e.out = append(e.out, SQ0, byte(ch))
+			e.stats.StaticWindowRunes[0]++
 		} else if dOffset := e.dynamicOffset[win]; ch >= dOffset && ch < dOffset+0x80 {
 			// Letters that fit the current dynamic window
 			ch -= dOffset
 			e.out = append(e.out, byte(ch|0x80))
+			e.stats.DynamicWindowRunes[win]++
 		} else {
 			// need to use some other compression mode for this
 			// character so we terminate this loop
 			break
 		}
+		e.stats.SingleByteRunes++
 		err := e.flush()
 		if err != nil {
 			return err
@@ -179,6 +520,67 @@ func (e *encoder) outputSingleByteRun() error {
 	return nil
 }
 
+// In streaming mode the output is flushed at least every maxAsciiChunk bytes of an ASCII run.
+const maxAsciiChunk = 4096
+
+func (e *encoder) asciiRunLimit(start, end int) int {
+	if e.wr != nil && end-start > maxAsciiChunk {
+		return start + maxAsciiChunk
+	}
+	return end
+}
+
+func isPassThrough(b byte) bool {
+	return isAsciiCrLfOrTab(rune(b)) || b == 0
+}
+
+// copy a run of bytes starting at the current character (which must be passed through)
+// and advance the source past it
+func (e *encoder) copyAsciiRun(s string) {
+	start := e.nextPos - 1
+	end, limit := e.nextPos, e.asciiRunLimit(start, len(s))
+	for end < limit && isPassThrough(s[end]) {
+		end++
+	}
+	e.out = append(e.out, s[start:end]...)
+	e.stats.SingleByteRunes += end - start
+	e.nextPos = end
+}
+
+func (e *encoder) copyAsciiRunBytes(s []byte) {
+	start := e.nextPos - 1
+	end, limit := e.nextPos, e.asciiRunLimit(start, len(s))
+	for end < limit && isPassThrough(s[end]) {
+		end++
+	}
+	e.out = append(e.out, s[start:end]...)
+	e.stats.SingleByteRunes += end - start
+	e.nextPos = end
+}
+
+/** output a run of characters that are passed through in single byte mode
+  (i.e. ASCII letters, NUL, CR, LF and TAB) bypassing the window logic.
+  For string and []byte sources the bytes are copied directly.
+  **/
+func (e *encoder) outputAsciiRun() {
+	switch s := e.src.(type) {
+	case StringRuneSource:
+		e.copyAsciiRun(string(s))
+	case StrictStringRuneSource:
+		e.copyAsciiRun(string(s))
+	case BytesRuneSource:
+		e.copyAsciiRunBytes(s)
+	default:
+		for n := 0; n < maxAsciiChunk && e.curErr == nil && (isAsciiCrLfOrTab(e.curRune) || e.curRune == 0); n++ {
+			e.out = append(e.out, byte(e.curRune))
+			e.stats.SingleByteRunes++
+			e.nextRune()
+		}
+		return
+	}
+	e.nextRune()
+}
+
 /** quote a single character in single byte mode
   Quoting a character (aka 'non-locking shift') gives efficient access
   to characters that occur in isolation--usually punctuation characters.
@@ -192,13 +594,16 @@ func (e *encoder) quoteSingleByte(ch rune) error {
 		// ... letter that fits the current dynamic window
 		ch -= offset
 		e.out = append(e.out, byte(ch|0x80))
+		e.stats.DynamicWindowRunes[e.window]++
 	} else if offset := staticOffset[e.window]; ch >= offset && ch < offset+0x80 {
 		// ... letter that fits the current static window
 		ch -= offset
 		e.out = append(e.out, byte(ch))
+		e.stats.StaticWindowRunes[e.window]++
 	} else {
 		return fmt.Errorf("ch = %d not valid in quoteSingleByte. Internal Compressor Error", ch)
 	}
+	e.stats.SingleByteRunes++
 
 	err := e.flush()
 	if err != nil {
@@ -207,6 +612,47 @@ func (e *encoder) quoteSingleByte(ch rune) error {
 	return nil
 }
 
+/** quote a single character from single byte mode using SQU
+  Characters outside of the BMP are quoted as two surrogates.
+  **/
+func (e *encoder) quoteUnicode(ch rune) error {
+	if ch < 0x10000 {
+		e.out = append(e.out, SQU, byte(ch>>8), byte(ch))
+	} else {
+		r1, r2 := utf16.EncodeRune(ch)
+		e.out = append(e.out, SQU, byte(r1>>8), byte(r1), SQU, byte(r2>>8), byte(r2))
+	}
+	e.stats.SingleByteRunes++
+	return e.flush()
+}
+
+// whether there are at least UnicodeModeThreshold consecutive compressible characters starting from the current
+// one (the first two are already known to be compressible) or they continue until the end of the input
+func (e *encoder) compressibleRun() (bool, error) {
+	t := e.opts.UnicodeModeThreshold
+	if t <= 2 {
+		return true, nil
+	}
+	if t > maxLookahead {
+		t = maxLookahead
+	}
+	c, p := e.curRune, e.nextPos
+	for n := 0; n < t; n++ {
+		if !isCompressible(c) {
+			return false, nil
+		}
+		var err error
+		c, p, err = e.runeAt(p)
+		if err != nil {
+			if err == io.EOF {
+				return true, nil
+			}
+			return false, err
+		}
+	}
+	return true, nil
+}
+
 /** output a run of characters in Unicode mode
   A run of Unicode mode consists of characters which are all in the
   range of non-compressible characters or isolated occurrence
@@ -219,26 +665,34 @@ func (e *encoder) outputUnicodeRun() (err error) {
 		var r1 rune
 		var n1 int
 		if isCompressible(r) {
-			r1, n1, err = e.src.RuneAt(n)
-			if err != nil && err != io.EOF {
+			r1, n1, err = e.runeAt(n)
+			if err == io.EOF {
+				// The current character is the last one, nextRune() below
+				// will pick up the EOF.
+				r1, n1, err = 0, 0, nil
+				if e.scuPos != -1 && (r == 0 || isAsciiCrLfOrTab(r)) {
+					// It is a pass-though character (i.e. can be encoded
+					// with one byte without changing a window) and we have
+					// only produced one unicode character so far.
+					// The result will be an SQU followed by a unicode character,
+					// followed by a single byte.
+					// If we didn't break here it would be one byte longer
+					// (SCU followed by 2 unicode characters).
+					break
+				}
+			} else if err != nil {
 				return
-			}
-			if err == nil && isCompressible(r1) {
-				// at least 2 characters are compressible
-				// break the run
-				break
-			}
-			if err != nil && e.scuPos != -1 && (r == 0 || isAsciiCrLfOrTab(r)) {
-				// The current character is the last one, it is a pass-though
-				// character (i.e. can be encoded with one byte without
-				// changing a window) and we have only produced one unicode
-				// character so far.
-				// The result will be an SQU followed by a unicode character,
-				// followed by a single byte.
-				// If we didn't break here it would be one byte longer
-				// (SCU followed by 2 unicode characters).
-				err = nil
-				break
+			} else if isCompressible(r1) && (e.preferWindow(r) && e.preferWindow(r1) || shareWindow(r, r1)) {
+				var long bool
+				long, err = e.compressibleRun()
+				if err != nil {
+					return
+				}
+				if long {
+					// at least 2 (or UnicodeModeThreshold) characters are compressible
+					// break the run
+					break
+				}
 			}
 		}
 
@@ -256,6 +710,7 @@ func (e *encoder) outputUnicodeRun() (err error) {
 			r1, r2 := utf16.EncodeRune(r)
 			e.out = append(e.out, byte(r1>>8), byte(r1), byte(r2>>8), byte(r2))
 		}
+		e.stats.UnicodeRunes++
 		if n1 != 0 {
 			e.curRune, e.nextPos = r1, n1
 		} else {
@@ -274,9 +729,53 @@ func (e *encoder) outputUnicodeRun() (err error) {
 	return
 }
 
+// how many characters the encoder looks ahead when choosing a window to redefine in OptimizeWindows mode
+const optimizeLookahead = 4096
+
+// how many characters the encoder looks ahead when choosing a window, it does not need more than that,
+// so a stream RuneSource (e.g. ReaderRuneSource) never buffers more than maxLookahead characters.
+const maxLookahead = optimizeLookahead
+
+// choose a dynamic window to redefine
+func (e *encoder) chooseWindowToRedefine() int {
+	if !e.opts.OptimizeWindows {
+		return e.nextWindow % 8 // simple LRU
+	}
+	// find the window which is not needed for the longest time
+	var needed [8]bool
+	left, last := 8, 0
+	c, p := e.curRune, e.nextPos
+	for i := 0; i < optimizeLookahead && left > 0; i++ {
+		if c >= 0x80 {
+			for win, offset := range e.dynamicOffset {
+				if !needed[win] && c >= offset && c < offset+0x80 {
+					needed[win] = true
+					left--
+					last = win
+				}
+			}
+		}
+		var err error
+		c, p, err = e.runeAt(p)
+		if err != nil {
+			// if it's not EOF, the error will be returned when the encoder gets there
+			break
+		}
+	}
+	if left == 0 {
+		return last
+	}
+	// the first one in LRU order that is not needed
+	for i := 0; i < 8; i++ {
+		if win := (e.nextWindow + i) % 8; !needed[win] {
+			return win
+		}
+	}
+	return last
+}
+
 // redefine a window so it surrounds a given character value
 func (e *encoder) positionWindow(ch rune, fUnicodeMode bool) bool {
-	iWin := e.nextWindow % 8 // simple LRU
 	var iPosition uint16
 
 	// iPosition 0 is a reserved value
@@ -284,30 +783,16 @@ func (e *encoder) positionWindow(ch rune, fUnicodeMode bool) bool {
 		panic("ch < 0x80")
 	}
 
-	// Check the fixed offsets
-	for i := 0; i < len(fixedOffset); i++ {
-		if offset := fixedOffset[i]; ch >= offset && ch < offset+0x80 {
-			iPosition = uint16(i)
-			break
-		}
+	if ch >= 0x3400 && ch < 0xE000 {
+		// attempt to place a window where none can go
+		return false
 	}
 
+	iWin := e.chooseWindowToRedefine()
 	extended := false
-	if iPosition != 0 {
-		e.dynamicOffset[iWin] = fixedOffset[iPosition]
-		iPosition += fixedThreshold
-	} else if ch < 0x3400 {
-		// calculate a window position command and set the offset
-		iPosition = uint16(ch >> 7)
-		e.dynamicOffset[iWin] = ch & 0xFF80
-	} else if ch < 0xE000 {
-		// attempt to place a window where none can go
-		return false
-	} else if ch <= 0xFFFF {
-		// calculate a window position command, accounting
-		// for the gap in position values, and set the offset
-		iPosition = uint16((ch - gapOffset) >> 7)
-		e.dynamicOffset[iWin] = ch & 0xFF80
+	if b, ok := WindowIndexFor(ch); ok {
+		iPosition = uint16(b)
+		e.dynamicOffset[iWin] = windowOffset(b)
 	} else {
 		// if we get here, the character is in the extended range.
 
@@ -339,9 +824,42 @@ func (e *encoder) positionWindow(ch rune, fUnicodeMode bool) bool {
 	}
 	e.window = iWin
 	e.nextWindow++
+	e.stats.WindowDefinitions++
 	return true
 }
 
+// WindowIndexFor returns the offset byte that the encoder would use in an SDn or UDn command to define
+// a dynamic window containing r. It returns false if r is ASCII, falls into the range that cannot be
+// covered by a window (U+3400-U+DFFF) or is outside of the BMP (such windows are defined with SDX or UDX).
+func WindowIndexFor(r rune) (index byte, ok bool) {
+	if r < 0x80 || r >= 0x3400 && r < 0xE000 || r > 0xFFFF {
+		return 0, false
+	}
+	// Check the fixed offsets. Note, the first one (Latin-1 letters) is never used as these characters
+	// are covered by the regular offsets.
+	for i := 1; i < len(fixedOffset); i++ {
+		if offset := fixedOffset[i]; r >= offset && r < offset+0x80 {
+			return byte(i + fixedThreshold), true
+		}
+	}
+	if r < 0x3400 {
+		return byte(r >> 7), true
+	}
+	// account for the gap in position values
+	return byte((r - gapOffset) >> 7), true
+}
+
+// windowOffset returns the window offset for an offset byte returned by WindowIndexFor
+func windowOffset(b byte) int32 {
+	if b >= fixedThreshold {
+		return fixedOffset[b-fixedThreshold]
+	}
+	if b >= gapThreshold {
+		return int32(b)<<7 + gapOffset
+	}
+	return int32(b) << 7
+}
+
 // Note, e.curRune must be compressible
 func (e *encoder) chooseWindow() error {
 	curCh, nextPos := e.curRune, e.nextPos
@@ -356,7 +874,7 @@ func (e *encoder) chooseWindow() error {
 	// unicode mode.
 	windowDecider := curCh
 	prevIncompressible := false
-	for c, p := curCh, nextPos; ; {
+	for c, p, i := curCh, nextPos, 0; i < maxLookahead; i++ {
 		if c >= 0x80 {
 			if !isCompressible(c) {
 				if c >= 0x10000 || prevIncompressible {
@@ -370,7 +888,7 @@ func (e *encoder) chooseWindow() error {
 		} else {
 			prevIncompressible = false
 		}
-		c, p, err = e.src.RuneAt(p)
+		c, p, err = e.runeAt(p)
 		if err != nil {
 			if err == io.EOF {
 				err = nil
@@ -386,7 +904,7 @@ func (e *encoder) chooseWindow() error {
 		// lookahead to use SQn instead of SCn for single
 		// character interruptions of runs in current window
 		if !e.unicodeMode {
-			ch2, n2, err := e.src.RuneAt(nextPos)
+			ch2, n2, err := e.runeAt(nextPos)
 			if err != nil && err != io.EOF {
 				return err
 			}
@@ -421,7 +939,21 @@ func (e *encoder) chooseWindow() error {
 		e.nextRune()
 		e.window = prevWindow // restore current Window settings
 		return nil
-	} else // try to define a window around windowDecider
+	} else if e.opts.QuoteIsolated && !e.unicodeMode {
+		isolated, err := e.isolated(curCh, nextPos)
+		if err != nil {
+			return err
+		}
+		if isolated {
+			err = e.quoteUnicode(curCh)
+			if err != nil {
+				return err
+			}
+			e.nextRune()
+			return nil
+		}
+	}
+	// try to define a window around windowDecider
 	if e.positionWindow(windowDecider, e.unicodeMode) {
 		e.unicodeMode = false
 		return nil
@@ -429,10 +961,70 @@ func (e *encoder) chooseWindow() error {
 	return errors.New("could not select window. Internal Compressor Error")
 }
 
+// isolated reports whether ch (which is at the position before pos) is not going to re-use the window that
+// would be defined for it (i.e. none of the following characters fits that window), and the first non-ASCII
+// character after it fits the current window
+func (e *encoder) isolated(ch rune, pos int) (bool, error) {
+	b, ok := WindowIndexFor(ch)
+	if !ok {
+		return false, nil
+	}
+	newOffset, offset := windowOffset(b), e.dynamicOffset[e.window]
+	fits := false
+	for i := 0; i < maxLookahead; i++ {
+		c, next, err := e.runeAt(pos)
+		if err != nil {
+			if err == io.EOF {
+				return fits, nil
+			}
+			return false, err
+		}
+		if c >= newOffset && c < newOffset+0x80 {
+			return false, nil
+		}
+		if c >= 0x80 && !fits {
+			if c < offset || c >= offset+0x80 {
+				return false, nil
+			}
+			fits = true
+		}
+		pos = next
+	}
+	return false, nil
+}
+
+// escapeLeadingBOM makes sure U+FEFF at the very start of the output is not encoded as the signature
+// (SQU FE FF, or FE FF in the initial Unicode mode) which the decoder would skip. Instead, it is encoded
+// using a window or quoted with UQU.
+func (e *encoder) escapeLeadingBOM() {
+	if e.unicodeMode {
+		e.out = append(e.out, UQU, 0xFE, 0xFF)
+		e.stats.UnicodeRunes++
+		e.nextRune()
+	} else if !e.fitsWindow(0xFEFF) {
+		e.positionWindow(0xFEFF, false)
+	}
+}
+
 func (e *encoder) encode(src RuneSource) error {
 	var err error
 	e.src, e.written, e.nextPos = src, 0, 0
+	start := len(e.out)
+	e.rel, _ = src.(runeReleaser)
+	if !e.started {
+		e.started = true
+		if e.opts.Signature {
+			if e.unicodeMode {
+				e.out = append(e.out, 0xFE, 0xFF)
+			} else {
+				e.out = append(e.out, signature[:]...)
+			}
+		}
+	}
 	e.nextRune()
+	if e.curErr == nil && e.curRune == 0xFEFF && e.bytesWritten == 0 && len(e.out) == start {
+		e.escapeLeadingBOM()
+	}
 
 	for {
 		if e.unicodeMode {
@@ -445,6 +1037,9 @@ func (e *encoder) encode(src RuneSource) error {
 				// go back and fix up the SCU to an SQU instead
 				e.out[e.scuPos] = SQU
 				e.scuPos = -1
+				e.stats.UnicodeSwitches--
+				e.stats.UnicodeRunes--
+				e.stats.SingleByteRunes++
 				err = e.flush()
 				if err != nil {
 					break
@@ -469,16 +1064,31 @@ func (e *encoder) encode(src RuneSource) error {
 			break
 		}
 		// note, if we were in unicode mode the character must be compressible
-		if isCompressible(e.curRune) {
+		compress := isCompressible(e.curRune) && (e.unicodeMode || e.preferWindow(e.curRune))
+		if !compress && e.opts.PreferUnicodeMode && isCompressible(e.curRune) {
+			if next, _, err := e.runeAt(e.nextPos); err == nil {
+				compress = shareWindow(e.curRune, next)
+			}
+		}
+		if compress {
 			err = e.chooseWindow()
 			if err != nil {
 				break
 			}
 		} else {
+			if e.opts.DisableUnicodeMode {
+				err = e.quoteUnicode(e.curRune)
+				if err != nil {
+					break
+				}
+				e.nextRune()
+				continue
+			}
 			// switching to unicode
 			e.scuPos = len(e.out)
 			e.out = append(e.out, SCU)
 			e.unicodeMode = true
+			e.stats.UnicodeSwitches++
 		}
 	}
 
@@ -486,7 +1096,14 @@ func (e *encoder) encode(src RuneSource) error {
 		err = e.flush()
 	}
 
-	e.src = nil // do not hold the reference
+	if e.rel != nil {
+		e.rel.done()
+	}
+	e.src, e.rel = nil, nil // do not hold the reference
+	if e.wr == nil {
+		e.written = len(e.out) - start
+	}
+	e.bytesWritten += int64(e.written)
 
 	return err
 }
@@ -499,12 +1116,38 @@ func (w *Writer) WriteString(in string) (int, error) {
 }
 
 // WriteRune encodes the given rune and writes the binary representation
-// into the writer.
+// into the writer. This can be used for incremental encoding, however because
+// there is no look-ahead the result may be less compact than encoding the whole input at once.
 // Returns the number of bytes written and an error (if any).
 func (w *Writer) WriteRune(r rune) (int, error) {
 	return w.WriteRunes(SingleRuneSource(r))
 }
 
+// ReadFrom implements io.ReaderFrom. It reads UTF-8 from r until io.EOF or an error occurs,
+// encodes it and writes the result into the writer. If r does not implement io.RuneReader it is
+// wrapped in a bufio.Reader. Invalid UTF-8 sequences result in ErrInvalidUTF8.
+// Returns the number of bytes read from r.
+func (w *Writer) ReadFrom(r io.Reader) (n int64, err error) {
+	rr, ok := r.(io.RuneReader)
+	if !ok {
+		rr = bufio.NewReader(r)
+	}
+	src := &streamRuneSource{
+		next: func() (rune, error) {
+			c, size, err := rr.ReadRune()
+			if err == nil {
+				if c == utf8.RuneError && size == 1 {
+					return 0, ErrInvalidUTF8
+				}
+				n += int64(size)
+			}
+			return c, err
+		},
+	}
+	_, err = w.WriteRunes(src)
+	return
+}
+
 func (w *Writer) WriteRunes(src RuneSource) (int, error) {
 	err := w.encode(src)
 	return w.written, err
@@ -521,8 +1164,114 @@ func (e *encoder) flush() error {
 	return nil
 }
 
-// Reset discards the encoder's state and makes it equivalent to the result of NewEncoder
-// called with w allowing to re-use the instance.
+// Stats returns the statistics collected since the Writer was created or Reset.
+func (w *Writer) Stats() EncoderStats {
+	return w.stats
+}
+
+// RunesWritten returns the number of characters encoded since the Writer was created or Reset.
+func (w *Writer) RunesWritten() int64 {
+	return int64(w.stats.SingleByteRunes) + int64(w.stats.UnicodeRunes)
+}
+
+// BytesWritten returns the number of bytes of output produced (including the signature) since the Writer
+// was created or Reset. Together with RunesWritten it can be used to calculate the compression ratio.
+func (w *Writer) BytesWritten() int64 {
+	return w.bytesWritten
+}
+
+// WindowState returns the current state of the encoder, i.e. the state the decoder is going
+// to be in after decoding the data written so far.
+func (w *Writer) WindowState() WindowState {
+	return w.windowState()
+}
+
+// NextRuneLen returns the number of bytes that writing r would produce given the current state of
+// the encoder, including any command needed to select or define a window. It does not change the state.
+// It's an estimate: the encoder does not decide on the mode switches and the windows until it sees
+// the characters that follow, so the estimate assumes the mode stays the same and the actual number
+// of bytes may differ (e.g. a character that does not fit any window may cause a switch to the Unicode mode
+// rather than being quoted). It returns -1 if r is not a valid Unicode scalar value.
+func (w *Writer) NextRuneLen(r rune) int {
+	return w.nextRuneLen(r)
+}
+
+func (e *encoder) nextRuneLen(ch rune) int {
+	if !utf8.ValidRune(ch) {
+		return -1
+	}
+	if e.unicodeMode {
+		if ch >= 0x10000 {
+			return 4
+		}
+		if hi := byte(ch >> 8); hi >= UC0 && hi <= Urs {
+			// must be quoted with UQU
+			return 3
+		}
+		return 2
+	}
+	if ch < 0x80 {
+		if isPassThrough(byte(ch)) {
+			return 1
+		}
+		// quoted with SQ0
+		return 2
+	}
+	if offset := e.dynamicOffset[e.window]; ch >= offset && ch < offset+0x80 {
+		return 1
+	}
+	if e.fitsWindow(ch) {
+		// selected with SCn or quoted with SQn
+		return 2
+	}
+	if ch < 0x10000 {
+		// SDn with an offset byte, or SQU
+		return 3
+	}
+	if isCompressible(ch) {
+		// SDX with 2 offset bytes
+		return 4
+	}
+	// quoted with SQU as a surrogate pair
+	return 6
+}
+
+// Flush makes sure all the encoded data has been written. The Writer does not hold back
+// any output between the calls, i.e. after each call the data written so far forms a complete SCSU
+// stream, therefore Flush only calls the Flush method of the underlying writer if it has one (e.g. bufio.Writer).
+// It does not reset the windows or the mode, if an independently decodable stream is required, use Reset.
+func (w *Writer) Flush() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if f, ok := w.wr.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// NewBufferWriter returns a Writer that appends the output to dst rather than writing it into an io.Writer.
+// The result can be retrieved with Bytes. A Writer created this way can be re-used by calling Reset(nil),
+// which keeps the capacity of the buffer.
+func NewBufferWriter(dst []byte) *Writer {
+	w := new(Writer)
+	w.out = dst
+	w.init()
+	return w
+}
+
+// Bytes returns the output of a Writer created by NewBufferWriter (or Reset with nil). If the Writer
+// has an underlying io.Writer, the output has already been written into it and Bytes returns nothing.
+func (w *Writer) Bytes() []byte {
+	if w.wr != nil {
+		return nil
+	}
+	return w.out
+}
+
+// Reset discards the writer's state and makes it equivalent to the result of NewWriter
+// called with out allowing to re-use the instance. If out is nil, the Writer appends the output
+// to its buffer, see NewBufferWriter.
 func (w *Writer) Reset(out io.Writer) {
 	w.wr = out
 	w.out = w.out[:0]
@@ -543,6 +1292,11 @@ func (e *Encoder) Encode(src RuneSource, dst []byte) ([]byte, error) {
 	return out, err
 }
 
+// Stats returns the statistics collected during the last call to Encode.
+func (e *Encoder) Stats() EncoderStats {
+	return e.stats
+}
+
 // Encode src and append to dst. If dst does not have enough capacity
 // it will be re-allocated. It can be nil.
 func Encode(src string, dst []byte) ([]byte, error) {
@@ -550,12 +1304,78 @@ func Encode(src string, dst []byte) ([]byte, error) {
 	return e.Encode(StringRuneSource(src), dst)
 }
 
-// EncodeStrict is the same as Encode, however it stops and returns ErrInvalidUTF8
-// if an invalid UTF-8 sequence is encountered rather than replacing it with
-// utf8.RuneError.
+// EncodeStrict is the same as Encode, however it stops and returns an *InvalidUTF8Error (which wraps
+// ErrInvalidUTF8) if an invalid UTF-8 sequence is encountered rather than replacing it with
+// utf8.RuneError. In this case dst is returned unmodified.
 func EncodeStrict(src string, dst []byte) ([]byte, error) {
 	var e Encoder
-	return e.Encode(StrictStringRuneSource(src), dst)
+	out, err := e.Encode(StrictStringRuneSource(src), dst)
+	if err != nil {
+		return dst, err
+	}
+	return out, nil
+}
+
+// AppendEncode encodes s and appends the result to dst. If dst does not have enough capacity
+// it will be re-allocated. It can be nil. This is the counterpart of AppendDecode, it is the same as EncodeStrict:
+// in case of an invalid UTF-8 sequence in s an *InvalidUTF8Error is returned and dst is returned unmodified.
+func AppendEncode(dst []byte, s string) ([]byte, error) {
+	return EncodeStrict(s, dst)
+}
+
+// EncodeWithInitialWindow encodes src assuming that the dynamic window iWindow is initially positioned
+// at the offset defined by the offset byte (as used by SDn, see WindowIndexFor) and is active. This saves
+// the bytes needed to define and select the window when the script of the text is known in advance.
+// The output must be decoded with the same settings, see DecodeWithInitialWindow.
+// It panics if iWindow or offset is out of range.
+func EncodeWithInitialWindow(src RuneSource, iWindow int, offset byte) ([]byte, error) {
+	return NewEncoderWithOptions(EncoderOptions{
+		InitialWindows:      initialWindow(iWindow, offset),
+		InitialActiveWindow: iWindow,
+	}).Encode(src, nil)
+}
+
+// Recompress decodes SCSU in b and encodes the result again with OptimizeWindows. This can reduce
+// the size of SCSU produced by a less sophisticated encoder. The decoded text is preserved,
+// however the output is not guaranteed to be shorter.
+func Recompress(b []byte) ([]byte, error) {
+	s, err := Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncoderWithOptions(EncoderOptions{OptimizeWindows: true}).Encode(StringRuneSource(s), make([]byte, 0, len(b)))
+}
+
+// EncodeTo encodes s and writes the result into w with a single Write call. It returns the number of bytes written.
+// If s is not a valid UTF-8 string, nothing is written and an *InvalidUTF8Error is returned, like in EncodeStrict.
+// The output is encoded into a pooled buffer, so w can be a hash.Hash, which allows to compute a hash of
+// the encoded data without allocating a buffer for it.
+func EncodeTo(w io.Writer, s string) (int, error) {
+	bp := stringBufPool.Get().(*[]byte)
+	var e Encoder
+	buf, err := e.Encode(StrictStringRuneSource(s), (*bp)[:0])
+	defer func() {
+		if cap(buf) <= maxPooledBufSize {
+			*bp = buf
+			stringBufPool.Put(bp)
+		}
+	}()
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(buf)
+}
+
+// EncodedLenMax returns an upper bound of the length of the SCSU representation of s, so that
+// a buffer of this capacity passed to Encode never needs to grow. The bound is derived as follows.
+// Counting each mode switch or window selection command together with the character that follows it,
+// no character takes more than 3 bytes of output per byte of its UTF-8 representation:
+// an ASCII character takes at most 3 (e.g. UC0 SQ0 0x01), a 2-byte sequence at most 3 (e.g. SD0 0x08 0x9C
+// or UD0 0x08 0x9C), a 3-byte sequence at most 3 (SQU, SCU or UQU followed by two bytes), a 4-byte sequence
+// at most 6 (SQU hi SQU lo). An invalid byte is replaced with U+FFFD which takes at most 3 bytes.
+// Additionally, the signature may need to be written (3 bytes).
+func EncodedLenMax(s string) int {
+	return 3*len(s) + len(signature)
 }
 
 // FindFirstEncodable returns the position of the first byte that is not pass-through.
@@ -568,3 +1388,80 @@ func FindFirstEncodable(src string) int {
 	}
 	return -1
 }
+
+// validUTF8Prefix returns the length of the longest prefix of b that consists of complete valid
+// UTF-8 sequences. If the prefix is followed by an invalid sequence, invalid is set to true.
+// Unless atEOF is set, an incomplete sequence at the end of b is not considered invalid.
+func validUTF8Prefix(b []byte, atEOF bool) (n int, invalid bool) {
+	for n < len(b) {
+		if !atEOF && !utf8.FullRune(b[n:]) {
+			return n, false
+		}
+		r, size := utf8.DecodeRune(b[n:])
+		if r == utf8.RuneError && size == 1 {
+			return n, true
+		}
+		n += size
+	}
+	return n, false
+}
+
+// NewUTF8Writer returns a UTF8Writer that writes into wr.
+func NewUTF8Writer(wr io.Writer) *UTF8Writer {
+	w := new(UTF8Writer)
+	w.w.wr = wr
+	w.w.init()
+	return w
+}
+
+// Write implements io.Writer. If p contains an invalid UTF-8 sequence, the valid part is encoded
+// and ErrInvalidUTF8 is returned. In case of an error n is the number of bytes of p that have been
+// consumed, including the ones that completed a sequence retained from the previous call.
+// If p does not complete the retained sequence correctly, the retained bytes are discarded and
+// ErrInvalidUTF8 is returned with n = 0, so p can be written again.
+func (w *UTF8Writer) Write(p []byte) (n int, err error) {
+	if w.tailLen > 0 {
+		// complete the sequence retained from the previous call
+		for n < len(p) && !utf8.FullRune(w.tail[:w.tailLen]) {
+			w.tail[w.tailLen] = p[n]
+			w.tailLen++
+			n++
+		}
+		if !utf8.FullRune(w.tail[:w.tailLen]) {
+			return n, nil
+		}
+		if c, _ := utf8.DecodeRune(w.tail[:w.tailLen]); c == utf8.RuneError {
+			// the retained bytes are invalid, the bytes of p are not consumed
+			w.tailLen = 0
+			return 0, ErrInvalidUTF8
+		}
+		_, err = w.w.WriteRunes(BytesRuneSource(w.tail[:w.tailLen]))
+		w.tailLen = 0
+		if err != nil {
+			// the bytes used to complete the sequence have been consumed
+			return n, err
+		}
+	}
+	l, invalid := validUTF8Prefix(p[n:], false)
+	if l > 0 {
+		if _, err = w.w.WriteRunes(BytesRuneSource(p[n : n+l])); err != nil {
+			return n, err
+		}
+		n += l
+	}
+	if invalid {
+		return n, ErrInvalidUTF8
+	}
+	w.tailLen = copy(w.tail[:], p[n:])
+	n += w.tailLen
+	return n, nil
+}
+
+// Close flushes the writer (see Writer.Flush). It returns ErrInvalidUTF8 if there is an incomplete
+// UTF-8 sequence retained from the last call to Write. It does not close the underlying writer.
+func (w *UTF8Writer) Close() error {
+	if w.tailLen > 0 {
+		return ErrInvalidUTF8
+	}
+	return w.w.Flush()
+}
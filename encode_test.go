@@ -1,10 +1,19 @@
 package scsu
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 const (
@@ -236,3 +245,1449 @@ func BenchmarkEncodeZeroAlloc(b *testing.B) {
 		buf = buf[:0]
 	}
 }
+
+func TestEncodeStrict(t *testing.T) {
+	buf, err := EncodeStrict("Москва", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte{0x12, 0x9C, 0xBE, 0xC1, 0xBA, 0xB2, 0xB0}) {
+		t.Fatalf("Content does not match: %v", buf)
+	}
+
+	_, err = EncodeStrict("Моск\xffва", nil)
+	if !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	buf, err = Encode("Моск\xffва", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "Моск�ва" {
+		t.Fatalf("Unexpected string: '%s'", s)
+	}
+}
+
+func TestWriterReset(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	// leave the writer in Unicode mode with a redefined window
+	if _, err := w.WriteString("Ελλάδα山自作"); err != nil {
+		t.Fatal(err)
+	}
+	var b1 bytes.Buffer
+	w.Reset(&b1)
+	if _, err := w.WriteString(referenceString); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b1.Bytes(), refEncoded) {
+		t.Fatalf("Content does not match: %v", b1.Bytes())
+	}
+}
+
+func TestAppendEncode(t *testing.T) {
+	buf := []byte("head")
+	buf, err := AppendEncode(buf, "Москва")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte{'h', 'e', 'a', 'd', 0x12, 0x9C, 0xBE, 0xC1, 0xBA, 0xB2, 0xB0}) {
+		t.Fatalf("Content does not match: %v", buf)
+	}
+
+	buf, err = AppendEncode(buf[:4], "Мос\xffква")
+	if !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(buf) != "head" {
+		t.Fatalf("Unexpected buf: %v", buf)
+	}
+}
+
+func TestRuneSliceSource(t *testing.T) {
+	if _, _, err := RuneSlice(nil).RuneAt(0); err != io.EOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var e Encoder
+	buf, err := e.Encode(RuneSlice(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 0 {
+		t.Fatalf("Unexpected buf: %v", buf)
+	}
+	buf, err = e.Encode(RuneSlice([]rune(referenceString)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, refEncoded) {
+		t.Fatalf("Content does not match: %v", buf)
+	}
+}
+
+func TestReaderRuneSource(t *testing.T) {
+	var e Encoder
+	src := ReaderRuneSource(strings.NewReader(strings.Repeat(referenceString, 100)))
+	buf, err := e.Encode(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != strings.Repeat(referenceString, 100) {
+		t.Fatal(s)
+	}
+	if c := cap(src.(*streamRuneSource).buf); c > 16 {
+		t.Fatalf("Buffer has grown too much: %d", c)
+	}
+
+	buf, err = e.Encode(ReaderRuneSource(strings.NewReader("Мос\xffква")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "Мос�ква" {
+		t.Fatal(s)
+	}
+
+	_, err = e.Encode(StrictReaderRuneSource(strings.NewReader("Мос\xffква")), nil)
+	if !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// the source is reused by the second call which continues where the first one stopped
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	src = ReaderRuneSource(bufio.NewReader(strings.NewReader("Москва")))
+	for i := 0; i < 2; i++ {
+		if _, err := w.WriteRunes(src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s, err := Decode(b.Bytes()); err != nil || s != "Москва" {
+		t.Fatal(s, err)
+	}
+}
+
+func TestWriteRuneSequence(t *testing.T) {
+	var b bytes.Buffer
+	e := NewWriter(&b)
+	total := 0
+	for _, r := range "Москва" {
+		n, err := e.WriteRune(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += n
+	}
+	if total != 7 {
+		t.Fatalf("Unexpected len: %d", total)
+	}
+	if !bytes.Equal(b.Bytes(), []byte{0x12, 0x9C, 0xBE, 0xC1, 0xBA, 0xB2, 0xB0}) {
+		t.Fatalf("Content does not match: %v", b.Bytes())
+	}
+}
+
+func TestWriteStringContinuous(t *testing.T) {
+	var b bytes.Buffer
+	e := NewWriter(&b)
+	n, err := e.WriteString("Мос")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("Unexpected len: %d", n)
+	}
+	// the window selected by the first call is re-used
+	n, err = e.WriteString("ква")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("Unexpected len: %d", n)
+	}
+	if !bytes.Equal(b.Bytes(), []byte{0x12, 0x9C, 0xBE, 0xC1, 0xBA, 0xB2, 0xB0}) {
+		t.Fatalf("Content does not match: %v", b.Bytes())
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	var b bytes.Buffer
+	bw := bufio.NewWriter(&b)
+	e := NewWriter(bw)
+	if _, err := e.WriteString("Москва"); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 {
+		t.Fatal("Flushed too early")
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), []byte{0x12, 0x9C, 0xBE, 0xC1, 0xBA, 0xB2, 0xB0}) {
+		t.Fatalf("Content does not match: %v", b.Bytes())
+	}
+}
+
+func TestEncoderStats(t *testing.T) {
+	var e Encoder
+	_, err := e.Encode(StringRuneSource("Москва Ελλάδα 可愛いや 山自作"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := e.Stats()
+	if stats != (EncoderStats{
+		WindowDefinitions: 1,
+		SingleByteRunes:   17,
+		UnicodeRunes:      5,
+		UnicodeSwitches:   2,
+
+		DynamicWindowRunes: [8]int{2: 6, 3: 6, 5: 2},
+	}) {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	for i := 0; i < 2; i++ {
+		if _, err := w.WriteString("Москва 山 "); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats = w.Stats()
+	if stats != (EncoderStats{
+		SingleByteRunes:    18, // 山 is quoted with SQU
+		DynamicWindowRunes: [8]int{2: 12},
+	}) {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	_, err = e.Encode(StringRuneSource("a\x01bМ–Мéa"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = e.Stats()
+	if stats.StaticWindowRunes != [8]int{0: 1, 4: 1} || stats.DynamicWindowRunes != [8]int{0: 1, 2: 2} {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestUnicodeModeThreshold(t *testing.T) {
+	const s = "Тест 可愛 тест 山 тест 可愛いや山自作 тест 𠀀𠀁 тест"
+	def, err := Encode(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEncoderWithOptions(EncoderOptions{UnicodeModeThreshold: 2})
+	buf, err := e.Encode(StringRuneSource(s), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, def) {
+		t.Fatal("Threshold 2 should be the default")
+	}
+
+	// short runs of punctuation that does not fit the default windows stay in Unicode mode
+	const cjk = "東京は日本の首都です。人口は約1400万人で、世界最大級の都市圏を形成しています。「東京都」は23の特別区、26の市、5つの町、8つの村から構成されています。"
+	var defEnc Encoder
+	def, err = defEnc.Encode(StringRuneSource(cjk), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = NewEncoderWithOptions(EncoderOptions{UnicodeModeThreshold: 3})
+	buf, err = e.Encode(StringRuneSource(cjk), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) >= len(def) {
+		t.Fatalf("%d >= %d", len(buf), len(def))
+	}
+	if stats := e.Stats(); stats.UnicodeSwitches >= defEnc.Stats().UnicodeSwitches {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	for _, threshold := range []int{3, 4, 8, 100} {
+		for _, s := range []string{s, cjk} {
+			buf, err := NewEncoderWithOptions(EncoderOptions{UnicodeModeThreshold: threshold}).Encode(StringRuneSource(s), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s1, err := Decode(buf); err != nil || s1 != s {
+				t.Fatal(s1, err)
+			}
+		}
+	}
+}
+
+func TestOptimizeWindows(t *testing.T) {
+	words := []string{
+		"Ελλάδα", "Москва", "Հայաստան", "ישראל", "ประเทศไทย", "საქართველო", "বাংলাদেশ", "தமிழ்நாடு", "ኢትዮጵያ",
+	}
+	var corpus []string
+	for i := 1; i < len(words); i++ {
+		var sb strings.Builder
+		for j := 0; j < 3; j++ {
+			for k := 0; k < len(words); k++ {
+				sb.WriteString(words[(k*i)%len(words)])
+				sb.WriteString(" — ")
+			}
+		}
+		corpus = append(corpus, sb.String())
+	}
+	corpus = append(corpus, referenceString)
+
+	greedyTotal, optimalTotal := 0, 0
+	e := NewEncoderWithOptions(EncoderOptions{OptimizeWindows: true})
+	for _, s := range corpus {
+		greedy, err := Encode(s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		optimal, err := e.Encode(StringRuneSource(s), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(optimal) > len(greedy) {
+			t.Fatalf("Optimal is larger than greedy (%d > %d) for '%s'", len(optimal), len(greedy), s)
+		}
+		s1, err := Decode(optimal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s1 != s {
+			t.Fatalf("Strings dont match: Expected: '%s', actual: '%s'", s, s1)
+		}
+		greedyTotal += len(greedy)
+		optimalTotal += len(optimal)
+	}
+	if optimalTotal >= greedyTotal {
+		t.Fatalf("Optimal is not smaller: %d, %d", optimalTotal, greedyTotal)
+	}
+	t.Logf("greedy: %d, optimal: %d", greedyTotal, optimalTotal)
+}
+
+func TestEncodeSignature(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriterWithOptions(&b, EncoderOptions{Signature: true})
+	for i := 0; i < 2; i++ {
+		if _, err := w.WriteString("Мо"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(b.Bytes(), []byte{SQU, 0xFE, 0xFF, 0x12, 0x9C, 0xBE, 0x9C, 0xBE}) {
+		t.Fatalf("Content does not match: %v", b.Bytes())
+	}
+	s, err := Decode(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "МоМо" {
+		t.Fatal(s)
+	}
+
+	e := NewEncoderWithOptions(EncoderOptions{Signature: true})
+	buf, err := e.Encode(StringRuneSource("\uFEFFtest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "\uFEFFtest" {
+		t.Fatalf("%q", s)
+	}
+}
+
+func TestEncodeLeadingBOM(t *testing.T) {
+	windows := [8]int32{0x80, 0xC0, 0x400, 0x600, 0x900, 0x3040, 0x30A0, 0xFF00}
+	for _, opts := range []EncoderOptions{
+		{},
+		{UnicodeModeThreshold: 4},
+		{OptimizeWindows: true},
+		{Signature: true},
+		{InitialWindows: &windows, InitialActiveWindow: 2},
+		{DisableUnicodeMode: true},
+		{PreferUnicodeMode: true},
+		{QuoteIsolated: true},
+		{InitialUnicodeMode: true},
+		{InitialUnicodeMode: true, PreferUnicodeMode: true},
+	} {
+		dopts := DecoderOptions{InitialWindows: opts.InitialWindows, InitialActiveWindow: opts.InitialActiveWindow,
+			InitialUnicodeMode: opts.InitialUnicodeMode}
+		for _, s := range []string{"\uFEFF", "\uFEFFabc", "\uFEFF\uFEFF", "\uFEFF東京", "\uFEFFèa", "\uFEFF😀"} {
+			b, err := NewEncoderWithOptions(opts).Encode(StringRuneSource(s), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := NewReaderWithOptions(bytes.NewReader(b), dopts).ReadString()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != s {
+				t.Fatalf("%+v: %q: %x decoded as %q", opts, s, b, res)
+			}
+
+			var buf bytes.Buffer
+			w := NewWriterWithOptions(&buf, opts)
+			for _, part := range []string{"", s} {
+				if _, err := w.WriteString(part); err != nil {
+					t.Fatal(err)
+				}
+			}
+			res, err = NewReaderWithOptions(bytes.NewReader(buf.Bytes()), dopts).ReadString()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != s {
+				t.Fatalf("%+v: %q: %x decoded as %q (Writer)", opts, s, buf.Bytes(), res)
+			}
+		}
+	}
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	input := strings.Repeat(referenceString, 20)
+	n, err := w.ReadFrom(iotest.HalfReader(strings.NewReader(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(input)) {
+		t.Fatalf("Unexpected n: %d", n)
+	}
+	s, err := Decode(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != input {
+		t.Fatal(s)
+	}
+
+	b.Reset()
+	w.Reset(&b)
+	_, err = w.ReadFrom(iotest.OneByteReader(strings.NewReader("Мос\xffква")))
+	if !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestUTF8Writer(t *testing.T) {
+	for _, size := range []int{1, 2, 3, 5, 1000} {
+		var b bytes.Buffer
+		w := NewUTF8Writer(&b)
+		input := []byte(referenceString + "Москва 😀")
+		for i := 0; i < len(input); i += size {
+			end := i + size
+			if end > len(input) {
+				end = len(input)
+			}
+			n, err := w.Write(input[i:end])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != end-i {
+				t.Fatalf("Unexpected n: %d", n)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		s, err := Decode(b.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != string(input) {
+			t.Fatalf("%d: %s", size, s)
+		}
+	}
+
+	var b bytes.Buffer
+	w := NewUTF8Writer(&b)
+	if _, err := w.Write([]byte("Мос\xe2\x82")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	w = NewUTF8Writer(&b)
+	if n, err := w.Write([]byte("Мос\xffква")); !errors.Is(err, ErrInvalidUTF8) || n != 6 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+
+	// an error while writing the sequence completed by the call
+	w = NewUTF8Writer(&failingWriter{n: 0})
+	if n, err := w.Write([]byte{0xD0}); err != nil || n != 1 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	if n, err := w.Write([]byte("\xbcabc")); err != errWriteFailed || n != 1 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	w = NewUTF8Writer(&b)
+	if n, err := w.Write([]byte{0xE2}); err != nil || n != 1 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	if n, err := w.Write([]byte("abc")); err != ErrInvalidUTF8 || n != 0 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	b.Reset()
+	w = NewUTF8Writer(&b)
+	if n, err := w.Write([]byte{0xD0}); err != nil || n != 1 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	if n, err := w.Write([]byte("AB")); err != ErrInvalidUTF8 || n != 0 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	// only the retained byte is dropped
+	if n, err := w.Write([]byte("AB")); err != nil || n != 2 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := Decode(b.Bytes()); err != nil || s != "AB" {
+		t.Fatalf("Unexpected result: %q, %v", s, err)
+	}
+}
+
+var errWriteFailed = errors.New("write failed")
+
+// failingWriter fails after n bytes have been written.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errWriteFailed
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestWindowState(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	r := NewReader(&buf)
+	if w.WindowState() != r.WindowState() {
+		t.Fatal("initial state differs")
+	}
+	for _, s := range []string{"Москва", " Ελλάδα", " 東京", " 😀", "abc"} {
+		if _, err := w.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if _, _, err := r.ReadRune(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ws, rs := w.WindowState(), r.WindowState(); ws != rs {
+			t.Fatalf("%q: %+v, %+v", s, ws, rs)
+		}
+	}
+	// ASCII does not need the active window to be changed
+	if st := r.WindowState(); st.UnicodeMode || st.DynamicOffsets[st.ActiveWindow] != 0x1F600 || st.DynamicOffsets[2] != 0x400 {
+		t.Fatalf("%+v", st)
+	}
+}
+
+func TestInitialWindows(t *testing.T) {
+	windows := initialDynamicOffset
+	windows[1], windows[2] = 0x0380, 0x0400 // Greek, Cyrillic
+	const s = "Москва Ελλάδα Москва"
+	e := NewEncoderWithOptions(EncoderOptions{InitialWindows: &windows})
+	b, err := e.Encode(StringRuneSource(s), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := e.Stats().WindowDefinitions; n != 0 {
+		t.Fatalf("WindowDefinitions: %d", n)
+	}
+	def, err := Encode(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) >= len(def) {
+		t.Fatalf("%d >= %d", len(b), len(def))
+	}
+
+	res, err := NewReaderWithOptions(bytes.NewReader(b), DecoderOptions{InitialWindows: &windows}).ReadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != s {
+		t.Fatal(res)
+	}
+	if res, _ := Decode(b); res == s {
+		t.Fatal("decoded with the default windows")
+	}
+
+	var buf bytes.Buffer
+	w := NewWriterWithOptions(&buf, EncoderOptions{InitialWindows: &windows})
+	w.WriteString(s)
+	if !bytes.Equal(buf.Bytes(), b) {
+		t.Fatalf("Writer output differs: % x, % x", buf.Bytes(), b)
+	}
+	w.Reset(&buf)
+	if w.WindowState().DynamicOffsets != windows {
+		t.Fatal("Reset did not restore the initial windows")
+	}
+
+	windows[7] = utf8.MaxRune
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	NewEncoderWithOptions(EncoderOptions{InitialWindows: &windows})
+}
+
+func TestEncodeWithInitialWindow(t *testing.T) {
+	for _, test := range []struct {
+		s       string
+		iWindow int
+	}{
+		{"Съешь же ещё этих мягких французских булок, да выпей чаю", 2},
+		{"Съешь же ещё этих мягких французских булок, да выпей чаю", 0},
+		{"Съешь же ещё этих (Ελλάδα) мягких французских булок", 6},
+	} {
+		offset, _ := WindowIndexFor('ж')
+		b, err := EncodeWithInitialWindow(StringRuneSource(test.s), test.iWindow, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		def, err := Encode(test.s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) >= len(def) {
+			t.Fatalf("%d: %d >= %d", test.iWindow, len(b), len(def))
+		}
+		res, err := DecodeWithInitialWindow(b, test.iWindow, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != test.s {
+			t.Fatalf("%d: %q", test.iWindow, res)
+		}
+	}
+
+	for _, test := range []struct {
+		iWindow int
+		offset  byte
+	}{
+		{8, 0x08},
+		{-1, 0x08},
+		{0, 0},
+		{0, ReservedStart},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%d, %#x: expected a panic", test.iWindow, test.offset)
+				}
+			}()
+			EncodeWithInitialWindow(StringRuneSource(""), test.iWindow, test.offset)
+		}()
+	}
+}
+
+func TestNextRuneLen(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if _, err := w.WriteString("Москва"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		r   rune
+		len int
+	}{
+		{'а', 1},
+		{'A', 1},
+		{'\n', 1},
+		{0x01, 2},
+		{'é', 2},
+		{'Ω', 3},
+		{'一', 3},
+		{'😀', 4},
+		{0x20001, 6},
+		{0xD800, -1},
+	} {
+		state := w.WindowState()
+		if n := w.NextRuneLen(test.r); n != test.len {
+			t.Fatalf("%U: %d != %d", test.r, n, test.len)
+		}
+		if w.WindowState() != state {
+			t.Fatalf("%U: the state has changed", test.r)
+		}
+	}
+	// in these cases the estimate is exact
+	for _, r := range []rune{'а', 'A', 0x01, 'é', 'Ω', 'ж', '一', '😀'} {
+		n := w.NextRuneLen(r)
+		l := buf.Len()
+		if _, err := w.WriteRune(r); err != nil {
+			t.Fatal(err)
+		}
+		if l1 := buf.Len() - l; l1 != n {
+			t.Fatalf("%U: %d != %d", r, l1, n)
+		}
+	}
+
+	if _, err := w.WriteString("\u4e00\u4e01\u4e02"); err != nil {
+		t.Fatal(err)
+	}
+	if !w.WindowState().UnicodeMode {
+		t.Fatal("expected Unicode mode")
+	}
+	for _, test := range []struct {
+		r   rune
+		len int
+	}{
+		{'A', 2},
+		{'一', 2},
+		{0xE000, 3},
+		{'😀', 4},
+	} {
+		if n := w.NextRuneLen(test.r); n != test.len {
+			t.Fatalf("%U: %d != %d", test.r, n, test.len)
+		}
+	}
+}
+
+func TestWriterCounters(t *testing.T) {
+	parts := []string{referenceString, "A", "一", "\U0001F600 Ελλάδα\x01", "一二三四五", strings.Repeat("x", 10000)}
+	var buf bytes.Buffer
+	w := NewWriterWithOptions(&buf, EncoderOptions{Signature: true})
+	runes := 0
+	for _, s := range parts {
+		if _, err := w.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+		runes += utf8.RuneCountInString(s)
+		if n := w.RunesWritten(); n != int64(runes) {
+			t.Fatalf("RunesWritten: %d != %d", n, runes)
+		}
+		if n := w.BytesWritten(); n != int64(buf.Len()) {
+			t.Fatalf("BytesWritten: %d != %d", n, buf.Len())
+		}
+	}
+	w.Reset(&buf)
+	if w.RunesWritten() != 0 || w.BytesWritten() != 0 {
+		t.Fatal("Reset did not reset the counters")
+	}
+
+	w = NewBufferWriter(nil)
+	w.WriteRune('ж')
+	if w.RunesWritten() != 1 || w.BytesWritten() != int64(len(w.Bytes())) {
+		t.Fatalf("%d, %d", w.RunesWritten(), w.BytesWritten())
+	}
+}
+
+func TestEncodeDeterministic(t *testing.T) {
+	input := strings.Repeat(referenceString+"Москва Ελλάδα ქართული \U0001F600\U0001F680 한국어 עברית", 20)
+	for _, opts := range []EncoderOptions{
+		{},
+		{OptimizeWindows: true},
+		{PreferUnicodeMode: true},
+		{UnicodeModeThreshold: 4},
+	} {
+		expected, err := NewEncoderWithOptions(opts).Encode(StringRuneSource(input), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := NewEncoderWithOptions(opts)
+		for i := 0; i < 100; i++ {
+			b, err := e.Encode(StringRuneSource(input), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, expected) {
+				t.Fatalf("%+v: run %d produced a different output", opts, i)
+			}
+		}
+		w := NewBufferWriter(nil)
+		for i := 0; i < 10; i++ {
+			w.opts = opts
+			w.Reset(nil)
+			w.WriteString(input)
+			if !bytes.Equal(w.Bytes(), expected) {
+				t.Fatalf("%+v: Writer run %d produced a different output", opts, i)
+			}
+		}
+	}
+}
+
+func TestEncodeToHash(t *testing.T) {
+	for _, s := range []string{
+		referenceString,
+		"a一b",  // the SCU is replaced with SQU
+		"一二三a", // a Unicode mode run
+		"Москва \U0001F600 Ελλάδα " + strings.Repeat("text ", 2000),
+	} {
+		b, err := Encode(s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := sha256.Sum256(b)
+		h := sha256.New()
+		if _, err := EncodeTo(h, s); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(h.Sum(nil), expected[:]) {
+			t.Fatalf("%q: hash mismatch", s)
+		}
+	}
+}
+
+func TestEncodeEmpty(t *testing.T) {
+	b, err := Encode("", nil)
+	if err != nil || len(b) != 0 {
+		t.Fatalf("% x, %v", b, err)
+	}
+	for _, src := range []RuneSource{StringRuneSource(""), StrictStringRuneSource(""), BytesRuneSource(nil), RuneSlice(nil), UTF16RuneSource(nil)} {
+		var e Encoder
+		b, err := e.Encode(src, nil)
+		if err != nil || len(b) != 0 {
+			t.Fatalf("%T: % x, %v", src, b, err)
+		}
+		if e.Stats() != (EncoderStats{}) {
+			t.Fatalf("%T: %+v", src, e.Stats())
+		}
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if n, err := w.WriteString(""); n != 0 || err != nil {
+		t.Fatalf("%d, %v", n, err)
+	}
+	if n, err := w.WriteRunes(RuneSlice(nil)); n != 0 || err != nil {
+		t.Fatalf("%d, %v", n, err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("% x", buf.Bytes())
+	}
+	if n, err := EncodeTo(&buf, ""); n != 0 || err != nil || buf.Len() != 0 {
+		t.Fatalf("%d, %v", n, err)
+	}
+}
+
+func TestInitialUnicodeMode(t *testing.T) {
+	for _, s := range []string{referenceString, "一二三四五六七八九十", "一二三 Москва", "Москва 一二三", "\U0001F600\uE000", ""} {
+		def, err := Encode(s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sig := range []bool{false, true} {
+			b, err := NewEncoderWithOptions(EncoderOptions{InitialUnicodeMode: true, Signature: sig}).Encode(StringRuneSource(s), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sig && len(def) > 0 && def[0] == SCU && !bytes.Equal(b, def[1:]) {
+				t.Fatalf("%q: % x, % x", s, b, def)
+			}
+			res, err := NewReaderWithOptions(bytes.NewReader(b), DecoderOptions{InitialUnicodeMode: true}).ReadString()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != s {
+				t.Fatalf("%q, %v: %q", s, sig, res)
+			}
+		}
+	}
+}
+
+func TestNUL(t *testing.T) {
+	for _, s := range []string{
+		"\x00",
+		"\x00\x00\x00",
+		"a\x00b",
+		"Москва\x00Москва",
+		"一\x00",
+		"一\x00二",
+		"一二三\x00四五六",
+		"\U0001F600\x00\U0001F600",
+		"Ελλάδα\x00一二\x00",
+	} {
+		b, err := Encode(s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, err := Decode(b); err != nil || res != s {
+			t.Fatalf("%q: %q, %v (% x)", s, res, err, b)
+		}
+		w := NewBufferWriter(nil)
+		for _, c := range s {
+			w.WriteRune(c)
+		}
+		if res, err := Decode(w.Bytes()); err != nil || res != s {
+			t.Fatalf("%q: WriteRune: %q, %v (% x)", s, res, err, w.Bytes())
+		}
+	}
+	// NUL is passed through in single byte mode
+	if b, _ := Encode("\x00a\x00", nil); !bytes.Equal(b, []byte{0x00, 'a', 0x00}) {
+		t.Fatalf("% x", b)
+	}
+}
+
+func TestQuoteIsolated(t *testing.T) {
+	alphabet := []rune{'a', 'é', 'Ω', 'ж', 'ψ', '一', '\U0001F600', '\uFF61', '\uFEFF'}
+	opts := EncoderOptions{QuoteIsolated: true}
+	smaller := 0
+	var check func(prefix []rune)
+	check = func(prefix []rune) {
+		if len(prefix) > 0 {
+			s := string(prefix)
+			b, err := NewEncoderWithOptions(opts).Encode(StringRuneSource(s), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			def, err := Encode(s, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) > len(def) {
+				t.Fatalf("%q: % x is longer than % x", s, b, def)
+			}
+			if len(b) < len(def) {
+				smaller++
+			}
+			if res, err := Decode(b); err != nil || res != s {
+				t.Fatalf("%q: %q, %v", s, res, err)
+			}
+		}
+		if len(prefix) < 4 {
+			for _, c := range alphabet {
+				check(append(prefix, c))
+			}
+		}
+	}
+	check(nil)
+	if smaller == 0 {
+		t.Fatal("the output is never smaller")
+	}
+	if b, _ := NewEncoderWithOptions(opts).Encode(StringRuneSource("éΩé"), nil); !bytes.Equal(b, []byte{0xE9, SQU, 0x03, 0xA9, 0xE9}) {
+		t.Fatalf("% x", b)
+	}
+	// a leading U+FEFF must not be quoted with SQU, otherwise it would be taken for the signature
+	if b, _ := NewEncoderWithOptions(opts).Encode(StringRuneSource("\uFEFFèa"), nil); bytes.HasPrefix(b, SignatureBytes()) {
+		t.Fatalf("% x", b)
+	}
+}
+
+var asciiDoc = strings.Repeat(`{"name": "Moscow", "country": "Russia", "population": 12506468},`+"\n", 1000)
+
+func BenchmarkEncodeASCII(b *testing.B) {
+	var e Encoder
+	var buf []byte
+	b.SetBytes(int64(len(asciiDoc)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, _ = e.Encode(StringRuneSource(asciiDoc), buf)
+		buf = buf[:0]
+	}
+}
+
+func BenchmarkWriterASCII(b *testing.B) {
+	w := NewWriter(ioutil.Discard)
+	b.SetBytes(int64(len(asciiDoc)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.Reset(ioutil.Discard)
+		_, _ = w.WriteString(asciiDoc)
+	}
+}
+
+func TestEncodeASCIIRun(t *testing.T) {
+	s := "abc\x00\tdef\r\nМосква\x01xyz" + strings.Repeat("q", 2*maxAsciiChunk+1) + "Ελλάδα\x7F"
+	var e Encoder
+	b, err := e.Encode(StringRuneSource(s), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := Decode(b); err != nil || res != s {
+		t.Fatalf("%q, %v", res, err)
+	}
+	for _, src := range []RuneSource{RuneSlice(s), StrictStringRuneSource(s), BytesRuneSource(s), ReaderRuneSource(strings.NewReader(s))} {
+		b1, err := e.Encode(src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b1, b) {
+			t.Fatalf("%T: output differs", src)
+		}
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if _, err := w.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), b) {
+		t.Fatal("Writer output differs")
+	}
+
+	// a long ASCII run is written in chunks
+	w.Reset(&failingWriter{n: maxAsciiChunk + 10})
+	if n, err := w.WriteString(strings.Repeat("a", 10*maxAsciiChunk)); err != errWriteFailed || n != maxAsciiChunk+10 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestBytesRuneSource(t *testing.T) {
+	var e Encoder
+	b, err := e.Encode(BytesRuneSource([]byte(referenceString)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, refEncoded) {
+		t.Fatalf("Content does not match: %v", b)
+	}
+
+	b, err = e.Encode(BytesRuneSource(nil), nil)
+	if err != nil || len(b) != 0 {
+		t.Fatal(b, err)
+	}
+
+	var invalidErr *InvalidUTF8Error
+	if _, err := e.Encode(BytesRuneSource("Моск\xd0"), nil); !errors.As(err, &invalidErr) || invalidErr.Offset != 8 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := e.Encode(BytesRuneSource("Мо\xffск"), nil); !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestInvalidUTF8Offset(t *testing.T) {
+	prefix := strings.Repeat("Москва, Ελλάδα, 東京. ", 200)
+	s := prefix + "\xff" + "tail"
+	_, err := EncodeStrict(s, nil)
+	var invalidErr *InvalidUTF8Error
+	if !errors.As(err, &invalidErr) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if invalidErr.Offset != len(prefix) {
+		t.Fatalf("Offset: %d != %d", invalidErr.Offset, len(prefix))
+	}
+	if !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatal("does not wrap ErrInvalidUTF8")
+	}
+	if expected := fmt.Sprintf("invalid UTF-8 at offset %d", len(prefix)); err.Error() != expected {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodedLenMax(t *testing.T) {
+	parts := []string{"a", "\x01", "\x00", "é", "Ж", "Ω", "東", "\uE000", "\uFEFF", "😀", "\U00010400", "\xff", "ゆ"}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		var sb strings.Builder
+		for n := rnd.Intn(16); n > 0; n-- {
+			sb.WriteString(parts[rnd.Intn(len(parts))])
+		}
+		s := sb.String()
+		for _, opts := range []EncoderOptions{{}, {Signature: true}, {UnicodeModeThreshold: 4}, {OptimizeWindows: true}} {
+			b, err := NewEncoderWithOptions(opts).Encode(StringRuneSource(s), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) > EncodedLenMax(s) {
+				t.Fatalf("%q, %+v: %d > %d", s, opts, len(b), EncodedLenMax(s))
+			}
+		}
+	}
+}
+
+func TestDisableUnicodeMode(t *testing.T) {
+	parts := []string{"a", "\x01", "é", "Ж", "Ω", "東京", "\uE000", "\uF8FF", "😀", "\U00020000", "\U0010FFFD", "ゆ"}
+	rnd := rand.New(rand.NewSource(1))
+	e := NewEncoderWithOptions(EncoderOptions{DisableUnicodeMode: true})
+	for i := 0; i < 1000; i++ {
+		var sb strings.Builder
+		sb.WriteString(referenceString[:rnd.Intn(10)*3])
+		for n := rnd.Intn(16); n > 0; n-- {
+			sb.WriteString(parts[rnd.Intn(len(parts))])
+		}
+		s := sb.String()
+		b, err := e.Encode(StringRuneSource(s), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Stats().UnicodeSwitches != 0 {
+			t.Fatalf("%q: unexpected stats %+v", s, e.Stats())
+		}
+		r := NewReader(bytes.NewReader(b))
+		var res []rune
+		for {
+			c, _, err := r.ReadRune()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.WindowState().UnicodeMode {
+				t.Fatalf("%q: Unicode mode in % x", s, b)
+			}
+			res = append(res, c)
+		}
+		if string(res) != s {
+			t.Fatalf("%q != %q", string(res), s)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	NewEncoderWithOptions(EncoderOptions{DisableUnicodeMode: true, InitialUnicodeMode: true})
+}
+
+func TestPreferUnicodeMode(t *testing.T) {
+	e := NewEncoderWithOptions(EncoderOptions{PreferUnicodeMode: true})
+
+	// more scripts than there are windows, interleaved
+	mixed := strings.Repeat("αбאعअกაաঅஅ", 10)
+	b, err := e.Encode(StringRuneSource(mixed), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, _ := Encode(mixed, nil)
+	if len(b) >= len(def) {
+		t.Fatalf("%d >= %d", len(b), len(def))
+	}
+	if e.Stats().WindowDefinitions != 0 {
+		t.Fatalf("%+v", e.Stats())
+	}
+	if s, err := Decode(b); err != nil || s != mixed {
+		t.Fatal(s, err)
+	}
+
+	// A character outside of the BMP takes 4 bytes in Unicode mode which is never less
+	// than defining a window (SDX takes 3 bytes plus 1 for the character), so emoji only
+	// benefit if they are mixed with BMP characters that don't fit the windows. The output
+	// must never be larger than the default.
+	emoji := strings.Repeat("😀🎉🚀👍🔥 🙏🌍🍕🐱⚽🎂🤖💡📚", 5)
+	for _, s := range []string{emoji, "😀a😀b🎉c", "Hi 😀! 👍 ok 🎉", referenceString, "Москва Ελλάδα 東京 😀 Москва"} {
+		b, err := e.Encode(StringRuneSource(s), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, err := Decode(b); err != nil || res != s {
+			t.Fatal(res, err)
+		}
+		def, _ := Encode(s, nil)
+		if len(b) > len(def) || s == emoji && len(b) >= len(def) {
+			t.Fatalf("%q: %d, default: %d", s, len(b), len(def))
+		}
+	}
+}
+
+func TestPreferUnicodeModeWriter(t *testing.T) {
+	for _, s := range []string{"ľ\uFED7\uE0DEab", "东京é\uE0DEab", "αбאعअ\uFED7", referenceString} {
+		for _, opts := range []EncoderOptions{{}, {PreferUnicodeMode: true}} {
+			for i := range s {
+				var buf bytes.Buffer
+				w := NewWriterWithOptions(&buf, opts)
+				for _, part := range []string{s[:i], s[i:]} {
+					if _, err := w.WriteString(part); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if res, err := Decode(buf.Bytes()); err != nil || res != s {
+					t.Fatalf("%+v, %q|%q: % x: %q, %v", opts, s[:i], s[i:], buf.Bytes(), res, err)
+				}
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, s := range []string{"", referenceString, "Москва Ελλάδα 東京 😀", "\U0010FFFD"} {
+		if err := RoundTrip(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := RoundTrip("Моск\xffва")
+	var rte *RoundTripError
+	if !errors.As(err, &rte) || rte.Op != "encode" || !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestEncodeInvalidRune(t *testing.T) {
+	var e Encoder
+	for _, src := range []RuneSource{
+		RuneSlice{'a', 0xD800, 'b'},
+		RuneSlice{'a', 0xDC00},
+		RuneSlice{0xD83D, 0xDE00},
+		RuneSlice{'М', 'о', 0x110000},
+		RuneSlice{-1},
+		SingleRuneSource(0xDFFF),
+	} {
+		if _, err := e.Encode(src, nil); !errors.Is(err, ErrInvalidRune) {
+			t.Fatalf("%v: unexpected error: %v", src, err)
+		}
+	}
+
+	w := NewWriter(ioutil.Discard)
+	if _, err := w.WriteRune(0xD800); !errors.Is(err, ErrInvalidRune) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestUTF16RuneSource(t *testing.T) {
+	const s = "Москва Ελλάδα 東京 😀\U0010FFFD"
+	var e Encoder
+	b, err := e.Encode(UTF16RuneSource(utf16.Encode([]rune(s))), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := Encode(s, nil)
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("% x", b)
+	}
+
+	for _, units := range [][]uint16{
+		{'a', 0xD83D},
+		{'a', 0xD83D, 'b'},
+		{0xDE00, 'b'},
+		{0xD83D, 0xD83D, 0xDE00},
+	} {
+		if _, err := e.Encode(UTF16RuneSource(units), nil); !errors.Is(err, ErrInvalidUTF16) {
+			t.Fatalf("%x: unexpected error: %v", units, err)
+		}
+	}
+}
+
+func TestWindowIndexFor(t *testing.T) {
+	for _, test := range []struct {
+		r     rune
+		index byte
+		ok    bool
+	}{
+		{'a', 0, false},
+		{'é', 0x01, true},
+		{'М', 0x08, true},
+		{'α', 0xFB, true},
+		{'ゆ', 0xFD, true},
+		{'東', 0, false},
+		{'한', 0, false},
+		{0xE000, 0x68, true},
+		{0xFFFD, 0xA7, true},
+		{'😀', 0, false},
+	} {
+		index, ok := WindowIndexFor(test.r)
+		if index != test.index || ok != test.ok {
+			t.Fatalf("%q: %#x, %v", test.r, index, ok)
+		}
+		if !ok {
+			continue
+		}
+		// the decoder must place the window so that it contains the character
+		r := NewReader(bytes.NewReader([]byte{SD0, index}))
+		if _, _, err := r.ReadRune(); err != io.EOF {
+			t.Fatal(err)
+		}
+		if offset := r.WindowState().DynamicOffsets[0]; test.r < offset || test.r >= offset+0x80 {
+			t.Fatalf("%q: %#x", test.r, offset)
+		}
+	}
+}
+
+func TestEncodeTo(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := EncodeTo(&buf, referenceString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(refEncoded) || !bytes.Equal(buf.Bytes(), refEncoded) {
+		t.Fatalf("%d: % x", n, buf.Bytes())
+	}
+
+	buf.Reset()
+	var invalidErr *InvalidUTF8Error
+	if n, err := EncodeTo(&buf, "Моск\xffва"); !errors.As(err, &invalidErr) || invalidErr.Offset != 8 || n != 0 || buf.Len() != 0 {
+		t.Fatal(n, err)
+	}
+
+	if n, err := EncodeTo(&failingWriter{n: 10}, referenceString); err != errWriteFailed || n != 10 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestChanRuneSource(t *testing.T) {
+	ch := make(chan rune)
+	go func() {
+		for _, r := range referenceString {
+			ch <- r
+		}
+		close(ch)
+	}()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if _, err := w.WriteRunes(ChanRuneSource(ch)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), refEncoded) {
+		t.Fatalf("Content does not match: %v", buf.Bytes())
+	}
+
+	ch = make(chan rune)
+	close(ch)
+	if b, err := new(Encoder).Encode(ChanRuneSource(ch), nil); err != nil || len(b) != 0 {
+		t.Fatal(b, err)
+	}
+}
+
+func TestBufferWriter(t *testing.T) {
+	var buf bytes.Buffer
+	sw := NewWriter(&buf)
+	w := NewBufferWriter([]byte("prefix"))
+	var total int
+	for _, c := range referenceString {
+		n, err := w.WriteRune(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += n
+		sw.WriteRune(c)
+	}
+	if string(w.Bytes()) != "prefix"+buf.String() || total != buf.Len() {
+		t.Fatalf("%d: % x", total, w.Bytes())
+	}
+
+	w.Reset(nil)
+	if n, err := w.WriteString(referenceString); err != nil || n != len(refEncoded) {
+		t.Fatal(n, err)
+	}
+	if !bytes.Equal(w.Bytes(), refEncoded) {
+		t.Fatalf("% x", w.Bytes())
+	}
+
+	w.Reset(ioutil.Discard)
+	w.WriteString(referenceString)
+	if w.Bytes() != nil {
+		t.Fatal("Bytes() must return nil")
+	}
+}
+
+func BenchmarkWriterBuffer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		_, _ = w.WriteString(referenceString)
+		_ = buf.Bytes()
+	}
+}
+
+func BenchmarkBufferWriter(b *testing.B) {
+	w := NewBufferWriter(nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.Reset(nil)
+		_, _ = w.WriteString(referenceString)
+		_ = w.Bytes()
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	// every character is preceded by a (redundant) window definition and
+	// the CJK characters are quoted one by one
+	var input []byte
+	for _, c := range "Москва" {
+		input = append(input, SD2, 0x08, byte(c-0x400+0x80))
+	}
+	for _, c := range "東京都" {
+		input = append(input, SQU, byte(c>>8), byte(c))
+	}
+	expected, err := Decode(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Recompress(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) >= len(input) {
+		t.Fatalf("%d >= %d", len(b), len(input))
+	}
+	if s, err := Decode(b); err != nil || s != expected {
+		t.Fatal(s, err)
+	}
+
+	if _, err := Recompress([]byte{'a', Srs}); !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// generates n runes cycling through the text
+type cyclingRuneReader struct {
+	text []rune
+	pos  int
+	n    int
+}
+
+func (r *cyclingRuneReader) ReadRune() (rune, int, error) {
+	if r.pos >= r.n {
+		return 0, 0, io.EOF
+	}
+	c := r.text[r.pos%len(r.text)]
+	r.pos++
+	return c, utf8.RuneLen(c), nil
+}
+
+// calls f on each Write
+type callbackWriter func(p []byte)
+
+func (w callbackWriter) Write(p []byte) (int, error) {
+	w(p)
+	return len(p), nil
+}
+
+func TestWriterIncremental(t *testing.T) {
+	text := []rune(referenceString + "Москва Ελλάδα 😀 東京" + strings.Repeat("a", 10000))
+	for _, opts := range []EncoderOptions{{}, {OptimizeWindows: true}, {UnicodeModeThreshold: 100000}} {
+		rr := &cyclingRuneReader{text: text, n: 1000000}
+		src := ReaderRuneSource(rr).(*streamRuneSource)
+		var writes, written int
+		maxBuffered, maxBehind := 0, 0
+		w := NewWriterWithOptions(callbackWriter(func(p []byte) {
+			writes++
+			written += len(p)
+			if len(src.buf) > maxBuffered {
+				maxBuffered = len(src.buf)
+			}
+			// the number of runes read from the source but not yet written
+			if behind := rr.pos - src.base; behind > maxBehind {
+				maxBehind = behind
+			}
+		}), opts)
+		if _, err := w.WriteRunes(src); err != nil {
+			t.Fatal(err)
+		}
+		if writes < 1000 || maxBuffered > maxLookahead+1 || maxBehind > maxLookahead+1 {
+			t.Fatalf("%+v: %d writes, %d buffered, %d behind", opts, writes, maxBuffered, maxBehind)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+//go:build go1.18
+// +build go1.18
+
+package scsu
+
+import (
+	"bytes"
+	"testing"
+	"unicode/utf8"
+)
+
+var fuzzSeeds = []string{
+	"",
+	"abc",
+	referenceString,
+	"Москва Ελλάδα 東京",
+	"😀🎉🚀 \U00010400\U0010FFFD",
+	"\x00\x01\t\r\n \uFEFF\uFFFD",
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(refEncoded)
+	for _, s := range fuzzSeeds {
+		b, err := Encode(s, nil)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s, err := Decode(data)
+		if err == nil && !utf8.ValidString(s) {
+			t.Fatalf("invalid UTF-8 in the output: %q", s)
+		}
+		s, err = NewReaderWithOptions(bytes.NewReader(data), DecoderOptions{Lenient: true}).ReadString()
+		if err == nil && !utf8.ValidString(s) {
+			t.Fatalf("invalid UTF-8 in the output: %q", s)
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		if !utf8.ValidString(s) {
+			t.Skip()
+		}
+		if err := RoundTrip(s); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
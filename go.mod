@@ -1,3 +1,5 @@
 module github.com/dop251/scsu
 
 go 1.13
+
+require golang.org/x/text v0.3.7
@@ -0,0 +1,44 @@
+//go:build go1.23
+// +build go1.23
+
+package scsu
+
+import (
+	"io"
+	"iter"
+)
+
+// Runes returns an iterator over the decoded characters. The iteration stops at io.EOF,
+// any other error is yielded along with a zero rune and the iteration stops.
+func (r *Reader) Runes() iter.Seq2[rune, error] {
+	return func(yield func(rune, error) bool) {
+		for {
+			c, err := r.readRune()
+			if err != nil {
+				if err != io.EOF {
+					yield(0, err)
+				}
+				return
+			}
+			if !yield(c, nil) {
+				return
+			}
+		}
+	}
+}
+
+// SeqRuneSource returns a RuneSource that pulls runes from seq. Only the runes that may be needed for
+// look-ahead are buffered. The iteration is stopped once the encoder is done with the source,
+// therefore it can only be used for one encoding operation.
+func SeqRuneSource(seq iter.Seq[rune]) RuneSource {
+	next, stop := iter.Pull(seq)
+	return &streamRuneSource{
+		next: func() (rune, error) {
+			if c, ok := next(); ok {
+				return c, nil
+			}
+			return 0, io.EOF
+		},
+		stop: stop,
+	}
+}
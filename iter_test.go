@@ -0,0 +1,82 @@
+//go:build go1.23
+// +build go1.23
+
+package scsu
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRunes(t *testing.T) {
+	var out []rune
+	for r, err := range NewReader(bytes.NewBuffer(refEncoded)).Runes() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, r)
+	}
+	if string(out) != referenceString {
+		t.Fatal(string(out))
+	}
+
+	out = out[:0]
+	var lastErr error
+	for r, err := range NewReader(bytes.NewBuffer([]byte{0x12, 0x9C, 0xBE, Srs, 0xC1})).Runes() {
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		out = append(out, r)
+	}
+	if !errors.Is(lastErr, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", lastErr)
+	}
+	if string(out) != "Мо" {
+		t.Fatal(string(out))
+	}
+
+	// break out of the loop early
+	for range NewReader(bytes.NewBuffer(refEncoded)).Runes() {
+		break
+	}
+}
+
+func TestSeqRuneSource(t *testing.T) {
+	seq := func(yield func(rune) bool) {
+		for _, r := range referenceString {
+			if !yield(r) {
+				return
+			}
+		}
+	}
+	var e Encoder
+	buf, err := e.Encode(SeqRuneSource(seq), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, refEncoded) {
+		t.Fatalf("Content does not match: %v", buf)
+	}
+
+	// the sequence is stopped if the encoder fails
+	stopped := false
+	seq = func(yield func(rune) bool) {
+		defer func() {
+			stopped = true
+		}()
+		for {
+			if !yield('a') {
+				return
+			}
+		}
+	}
+	w := NewWriter(&failingWriter{})
+	if _, err := w.WriteRunes(SeqRuneSource(seq)); err != errWriteFailed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !stopped {
+		t.Fatal("The sequence was not stopped")
+	}
+}
@@ -1,5 +1,11 @@
 package scsu
 
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
 const (
 	/** Single Byte mode command values */
 
@@ -125,12 +131,76 @@ var (
 	}
 )
 
+// Window offset byte values (as used by SDn and UDn) that are treated specially, see defineWindow.
+const (
+	GapThreshold   = gapThreshold   // offset bytes from this value have GapOffset added
+	GapOffset      = gapOffset      // added to the offset for offset bytes from GapThreshold
+	ReservedStart  = reservedStart  // offset bytes from this value up to FixedThreshold are reserved
+	FixedThreshold = fixedThreshold // offset bytes from this value index into the fixed offsets table
+)
+
+// StaticOffsets returns the offsets of the 8 static windows.
+func StaticOffsets() [8]int32 {
+	return staticOffset
+}
+
+// InitialDynamicOffsets returns the default initial offsets of the 8 dynamic windows.
+func InitialDynamicOffsets() [8]int32 {
+	return initialDynamicOffset
+}
+
+// FixedOffsets returns the table of predefined offsets that the offset bytes from FixedThreshold
+// (0xF9-0xFF) refer to.
+func FixedOffsets() [7]int32 {
+	return fixedOffset
+}
+
+// U+FEFF quoted in single byte mode
+var signature = [...]byte{SQU, 0xFE, 0xFF}
+
+// SignatureBytes returns a copy of the SCSU signature (U+FEFF quoted with SQU: 0E FE FF). It is written
+// at the start of the output if EncoderOptions.Signature is set and skipped by the Reader.
+func SignatureBytes() []byte {
+	return append([]byte(nil), signature[:]...)
+}
+
 type scsu struct {
 	window        int // current active window
 	unicodeMode   bool
 	dynamicOffset [8]int32
 }
 
+// WindowState is a snapshot of the SCSU state machine, intended for diagnostics.
+type WindowState struct {
+	DynamicOffsets [8]int32 // offsets of the dynamic windows
+	ActiveWindow   int      // index of the active dynamic window
+	UnicodeMode    bool     // whether the Unicode mode is active
+}
+
+func (scsu *scsu) windowState() WindowState {
+	return WindowState{
+		DynamicOffsets: scsu.dynamicOffset,
+		ActiveWindow:   scsu.window,
+		UnicodeMode:    scsu.unicodeMode,
+	}
+}
+
+// Window describes a dynamic window.
+type Window struct {
+	index  int
+	offset int32
+}
+
+// Index returns the index of the window (0-7).
+func (w Window) Index() int {
+	return w.index
+}
+
+// Offset returns the first character of the window.
+func (w Window) Offset() int32 {
+	return w.offset
+}
+
 /** whether a character is compressible */
 func isCompressible(ch rune) bool {
 	return ch < 0x3400 || ch >= 0xE000 && ch <= 0x20000
@@ -140,7 +210,76 @@ func (scsu *scsu) init() {
 	scsu.dynamicOffset = initialDynamicOffset
 }
 
+// checkInitialWindows panics if any of the offsets cannot be used as a dynamic window
+// or if active is not a valid window index.
+func checkInitialWindows(offsets *[8]int32, active int) {
+	if active < 0 || active > 7 {
+		panic(fmt.Errorf("scsu: invalid initial active window %d", active))
+	}
+	if offsets == nil {
+		return
+	}
+	for i, offset := range offsets {
+		if offset < 0 || offset > utf8.MaxRune-0x7F {
+			panic(fmt.Errorf("scsu: invalid initial offset %#x for window %d", offset, i))
+		}
+	}
+}
+
+// initialWindow returns the default initial offsets with the window iWindow positioned at the offset
+// that is defined by the offset byte (as used by SDn and UDn). It panics if either is out of range.
+func initialWindow(iWindow int, offset byte) *[8]int32 {
+	if iWindow < 0 || iWindow > 7 {
+		panic(fmt.Errorf("scsu: invalid window index %d", iWindow))
+	}
+	if offset == 0 || offset >= reservedStart && offset < fixedThreshold {
+		panic(fmt.Errorf("scsu: reserved window offset %#x", offset))
+	}
+	offsets := initialDynamicOffset
+	offsets[iWindow] = windowOffset(offset)
+	return &offsets
+}
+
 func (scsu *scsu) reset() {
 	scsu.window = 0
 	scsu.unicodeMode = false
 }
+
+// ErrMismatch is returned (wrapped in a *RoundTripError) by RoundTrip if the decoded string
+// differs from the original.
+var ErrMismatch = errors.New("decoded string does not match the original")
+
+// RoundTripError is returned by RoundTrip. Op is the stage that failed: "encode", "decode" or "compare".
+type RoundTripError struct {
+	Op  string
+	Err error
+}
+
+func (e *RoundTripError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *RoundTripError) Unwrap() error {
+	return e.Err
+}
+
+// RoundTrip encodes s using EncodeStrict, decodes the result and compares it with s. It can be used
+// in fuzz tests. If s is not a valid UTF-8 string the returned error wraps ErrInvalidUTF8.
+func RoundTrip(s string) error {
+	b, err := EncodeStrict(s, nil)
+	if err != nil {
+		return &RoundTripError{Op: "encode", Err: err}
+	}
+	s1, err := Decode(b)
+	if err != nil {
+		return &RoundTripError{Op: "decode", Err: fmt.Errorf("%w (encoded: % x)", err, b)}
+	}
+	if s1 != s {
+		i := 0
+		for i < len(s) && i < len(s1) && s[i] == s1[i] {
+			i++
+		}
+		return &RoundTripError{Op: "compare", Err: fmt.Errorf("%w: %q != %q, first difference at byte %d", ErrMismatch, s1, s, i)}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package scsu
+
+// Text is a string that is represented as SCSU when marshalled. It implements encoding.TextMarshaler
+// and encoding.TextUnmarshaler, so it can be used in structs with packages that honour these interfaces.
+// Note that SCSU is binary, so the result is only useful with formats that can carry arbitrary bytes.
+type Text string
+
+// MarshalText encodes the string as SCSU. If the string is not a valid UTF-8, the returned error wraps ErrInvalidUTF8.
+func (t Text) MarshalText() ([]byte, error) {
+	return EncodeStrict(string(t), nil)
+}
+
+// UnmarshalText decodes SCSU into the string. In case of an error the value is left unchanged.
+func (t *Text) UnmarshalText(b []byte) error {
+	s, err := Decode(b)
+	if err != nil {
+		return err
+	}
+	*t = Text(s)
+	return nil
+}
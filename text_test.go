@@ -0,0 +1,40 @@
+package scsu
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"testing"
+)
+
+var (
+	_ encoding.TextMarshaler   = Text("")
+	_ encoding.TextUnmarshaler = (*Text)(nil)
+)
+
+func TestText(t *testing.T) {
+	b, err := Text(referenceString).MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, refEncoded) {
+		t.Fatalf("Content does not match: %v", b)
+	}
+	var txt Text
+	if err := txt.UnmarshalText(b); err != nil {
+		t.Fatal(err)
+	}
+	if txt != referenceString {
+		t.Fatal(txt)
+	}
+
+	if _, err := Text("Моск\xffва").MarshalText(); !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := txt.UnmarshalText([]byte{'a', Srs}); !errors.Is(err, ErrIllegalInput) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if txt != referenceString {
+		t.Fatal("the value has been modified")
+	}
+}
@@ -0,0 +1,131 @@
+package scsu
+
+import (
+	"io"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// SCSU is an encoding.Encoding that can be used with golang.org/x/text packages,
+// for example transform.NewReader(r, SCSU.NewDecoder()).
+var SCSU encoding.Encoding = scsuEncoding{}
+
+type scsuEncoding struct{}
+
+func (scsuEncoding) NewDecoder() *encoding.Decoder {
+	return &encoding.Decoder{Transformer: NewDecodeTransformer()}
+}
+
+func (scsuEncoding) NewEncoder() *encoding.Encoder {
+	return &encoding.Encoder{Transformer: newEncodeTransformer()}
+}
+
+func (scsuEncoding) String() string {
+	return "SCSU"
+}
+
+// DecodeTransformer is a transform.Transformer that decodes SCSU into UTF-8.
+// The window state is preserved between the calls to Transform, so the input can
+// be split at arbitrary positions. If a command or a character sequence is split across
+// the src boundary, Transform returns transform.ErrShortSrc (unless atEOF is true, in which
+// case io.ErrUnexpectedEOF is returned).
+type DecodeTransformer struct {
+	rd  Reader
+	src sliceByteReader
+}
+
+// NewDecodeTransformer returns a DecodeTransformer in the initial state.
+func NewDecodeTransformer() *DecodeTransformer {
+	t := new(DecodeTransformer)
+	t.Reset()
+	return t
+}
+
+// Transform implements transform.Transformer.
+func (t *DecodeTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	t.src.b, t.src.pos = src, 0
+	defer func() {
+		t.src.b = nil
+	}()
+	var buf [utf8.UTFMax]byte
+	for {
+		// save the state so that an incomplete sequence can be re-read on the next call
+		state := t.rd.state()
+		c, err := t.rd.readRune()
+		if err != nil {
+			if err == io.EOF {
+				return nDst, t.src.pos, nil
+			}
+			t.rd.setState(state)
+			if err == io.ErrUnexpectedEOF && !atEOF {
+				return nDst, nSrc, transform.ErrShortSrc
+			}
+			return nDst, nSrc, err
+		}
+		n := utf8.EncodeRune(buf[:], c)
+		if nDst+n > len(dst) {
+			t.rd.setState(state)
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += copy(dst[nDst:], buf[:n])
+		nSrc = t.src.pos
+	}
+}
+
+// Reset resets the state to the initial one.
+func (t *DecodeTransformer) Reset() {
+	t.rd.Reset(&t.src)
+}
+
+type encodeTransformer struct {
+	e       encoder // wr is nil, so the output is accumulated in e.out
+	pending int     // position of the first byte in e.out that hasn't been copied into dst yet
+}
+
+func newEncodeTransformer() *encodeTransformer {
+	t := new(encodeTransformer)
+	t.Reset()
+	return t
+}
+
+func (t *encodeTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if t.pending < len(t.e.out) {
+		nDst = copy(dst, t.e.out[t.pending:])
+		t.pending += nDst
+		if t.pending < len(t.e.out) {
+			return nDst, 0, transform.ErrShortDst
+		}
+	}
+	t.e.out, t.pending = t.e.out[:0], 0
+
+	n, invalid := validUTF8Prefix(src, atEOF)
+	if invalid {
+		err = ErrInvalidUTF8
+	} else if n < len(src) {
+		err = transform.ErrShortSrc
+	}
+
+	if n > 0 {
+		if err1 := t.e.encode(BytesRuneSource(src[:n])); err1 != nil {
+			return nDst, 0, err1
+		}
+		nSrc = n
+		written := copy(dst[nDst:], t.e.out)
+		nDst += written
+		if written < len(t.e.out) {
+			t.pending = written
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		t.e.out = t.e.out[:0]
+	}
+
+	return nDst, nSrc, err
+}
+
+func (t *encodeTransformer) Reset() {
+	t.e.out, t.pending = t.e.out[:0], 0
+	t.e.reset()
+	t.e.init()
+}
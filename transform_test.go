@@ -0,0 +1,149 @@
+package scsu
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"golang.org/x/text/transform"
+)
+
+// runTransformer feeds src to t in chunks of srcSize bytes using a dst buffer of dstSize bytes.
+func runTransformer(t transform.Transformer, src []byte, srcSize, dstSize int) ([]byte, error) {
+	var out []byte
+	dst := make([]byte, dstSize)
+	var chunk []byte
+	for {
+		if len(chunk) < srcSize && len(src) > 0 {
+			n := srcSize - len(chunk)
+			if n > len(src) {
+				n = len(src)
+			}
+			chunk = append(chunk, src[:n]...)
+			src = src[n:]
+		}
+		atEOF := len(src) == 0
+		nDst, nSrc, err := t.Transform(dst, chunk, atEOF)
+		out = append(out, dst[:nDst]...)
+		chunk = chunk[nSrc:]
+		switch err {
+		case nil:
+			if atEOF && len(chunk) == 0 {
+				return out, nil
+			}
+		case transform.ErrShortDst:
+		case transform.ErrShortSrc:
+			if atEOF {
+				return out, errors.New("ErrShortSrc at EOF")
+			}
+			srcSize++
+		default:
+			return out, err
+		}
+	}
+}
+
+func TestDecodeTransformer(t *testing.T) {
+	for _, srcSize := range []int{1, 2, 3, 7, 1000} {
+		for _, dstSize := range []int{4, 5, 1000} {
+			out, err := runTransformer(SCSU.NewDecoder(), refEncoded, srcSize, dstSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != referenceString {
+				t.Fatalf("%d/%d: %s", srcSize, dstSize, out)
+			}
+		}
+	}
+}
+
+func TestEncodeTransformer(t *testing.T) {
+	src := []byte(referenceString + "Москва Ελλάδα 😀")
+	for _, srcSize := range []int{1, 2, 3, 7, 1000} {
+		for _, dstSize := range []int{1, 2, 5, 1000} {
+			out, err := runTransformer(SCSU.NewEncoder(), src, srcSize, dstSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := Decode(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s != string(src) {
+				t.Fatalf("%d/%d: %s", srcSize, dstSize, s)
+			}
+		}
+	}
+}
+
+func TestEncodeTransformerInvalidUTF8(t *testing.T) {
+	_, err := runTransformer(SCSU.NewEncoder(), []byte("Моск\xffва"), 3, 100)
+	if !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestTransformReader(t *testing.T) {
+	b, err := ioutil.ReadAll(transform.NewReader(iotest.OneByteReader(bytes.NewReader(refEncoded)), SCSU.NewDecoder()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != referenceString {
+		t.Fatal(string(b))
+	}
+
+	var buf bytes.Buffer
+	w := transform.NewWriter(&buf, SCSU.NewEncoder())
+	for _, c := range []byte(referenceString) {
+		if _, err := w.Write([]byte{c}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Decode(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != referenceString {
+		t.Fatal(s)
+	}
+}
+
+func TestDecodeTransformerShortSrc(t *testing.T) {
+	for _, input := range [][]byte{
+		{0x41, SD0, 0xFB},                  // Greek window definition
+		{SCU, 0xD8, 0x3D, 0xDE, 0x00},      // surrogate pair in Unicode mode
+		{SQU, 0xD8, 0x3D, SQU, 0xDE, 0x00}, // quoted surrogate pair
+		{SDX, 0x00, 0x00, 0x80},            // extended window
+	} {
+		want, err := Decode(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := make([]byte, 16)
+		for i := 1; i < len(input); i++ {
+			tr := NewDecodeTransformer()
+			nDst, nSrc, err := tr.Transform(dst, input[:i], false)
+			if err != nil && err != transform.ErrShortSrc {
+				t.Fatalf("%v, %d: unexpected error: %v", input, i, err)
+			}
+			out := string(dst[:nDst])
+			nDst, n, err := tr.Transform(dst, input[nSrc:], true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out += string(dst[:nDst])
+			if nSrc+n != len(input) || out != want {
+				t.Fatalf("%v, %d: unexpected result: %d, %q", input, i, nSrc+n, out)
+			}
+		}
+		if _, _, err := NewDecodeTransformer().Transform(dst, input[:2], true); err != io.ErrUnexpectedEOF {
+			t.Fatalf("%v: unexpected error: %v", input, err)
+		}
+	}
+}